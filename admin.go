@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A ChannelConfig along with its display name for the admin pages
+type AdminChannel struct {
+	Name   string
+	Config *ChannelConfig
+}
+
+// Redirects back to the admin index with a message to show the user
+func adminRedirect(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, "/admin/?msg="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+// Looks up the channel config named in the request path, writing a 404 if it doesn't exist
+func adminChannelConfig(env *Env, w http.ResponseWriter, r *http.Request) (*ChannelConfig, bool) {
+	c, ok := env.DiscordBot.ChannelConfig(r.PathValue("channel"))
+	if !ok {
+		http.Error(w, "channel not found", http.StatusNotFound)
+	}
+
+	return c, ok
+}
+
+// Builds a rule from the query, max_price, brand and event form values. Empty filters match anything.
+func ruleFromForm(r *http.Request) (*ChannelConfigRule, error) {
+	rule := &ChannelConfigRule{
+		Query: r.FormValue("query"),
+		Brand: r.FormValue("brand"),
+		Event: r.FormValue("event"),
+	}
+
+	if v := strings.TrimPrefix(strings.TrimSpace(r.FormValue("max_price")), "$"); v != "" {
+		maxPrice, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a price", r.FormValue("max_price"))
+		}
+		rule.MaxPrice = maxPrice
+	}
+
+	return rule, nil
+}
+
+// Lists every channel configuration with its subscription state and rules
+func HandleAdminIndex(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var channels []*AdminChannel
+		for _, c := range env.DiscordBot.ChannelConfigs() {
+			channels = append(channels, &AdminChannel{
+				Name:   env.DiscordBot.ChannelName(c.ChannelID),
+				Config: c,
+			})
+		}
+
+		tmpl_data := map[string]any{
+			"Channels":  channels,
+			"Message":   r.URL.Query().Get("msg"),
+			"User":      CurrentUser(r),
+			"CSRFToken": CSRFToken(r),
+			"Brands":    ruleBrands,
+			"Events":    []string{RuleEventAny, RuleEventPriceDrop, RuleEventRestock},
+		}
+		err := env.Templates.Render(w, "admin", tmpl_data)
+		if err != nil {
+			log.Println("error in route admin: ", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	return handler
+}
+
+// Subscribes or unsubscribes a channel depending on the "subscribed" form value
+func HandleAdminSubscription(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		c, ok := adminChannelConfig(env, w, r)
+		if !ok {
+			return
+		}
+
+		var err error
+		if r.FormValue("subscribed") == "true" {
+			err = c.Subscribe(env)
+		} else {
+			err = c.Unsubscribe(env)
+		}
+		if err != nil {
+			adminRedirect(w, r, fmt.Sprintf("Could not update subscription for %s: %s", c.ChannelID, err.Error()))
+			return
+		}
+
+		adminRedirect(w, r, fmt.Sprintf("Updated subscription for %s", c.ChannelID))
+	}
+
+	return handler
+}
+
+// Adds a rule with any filters to a channel
+func HandleAdminAddRule(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		c, ok := adminChannelConfig(env, w, r)
+		if !ok {
+			return
+		}
+
+		rule, err := ruleFromForm(r)
+		if err == nil {
+			err = c.AddRule(rule, env)
+		}
+		if err != nil {
+			adminRedirect(w, r, fmt.Sprintf("Unable to create rule: %s", err.Error()))
+			return
+		}
+
+		description := fmt.Sprintf("\"%s\"", rule.Query)
+		if filters := rule.Filters(); filters != "" {
+			description += " (" + filters + ")"
+		}
+		adminRedirect(w, r, fmt.Sprintf("New rule created for %s", description))
+	}
+
+	return handler
+}
+
+// Replaces a rule's query on a channel, keeping its filters. The new rule is added before the old one is
+// removed so a rejected edit leaves the channel unchanged.
+func HandleAdminEditRule(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		c, ok := adminChannelConfig(env, w, r)
+		if !ok {
+			return
+		}
+
+		old := r.FormValue("old")
+		query := r.FormValue("query")
+		rule := &ChannelConfigRule{Query: query}
+		if existing, ok := c.Rule(old); ok {
+			rule.MaxPrice = existing.MaxPrice
+			rule.Brand = existing.Brand
+			rule.Event = existing.Event
+		}
+
+		err := c.AddRule(rule, env)
+		if err != nil {
+			adminRedirect(w, r, fmt.Sprintf("Unable to edit rule: %s", err.Error()))
+			return
+		}
+
+		err = c.RemoveRule(old, env)
+		if err != nil {
+			adminRedirect(w, r, fmt.Sprintf("Added \"%s\" but could not remove \"%s\": %s", query, old, err.Error()))
+			return
+		}
+
+		adminRedirect(w, r, fmt.Sprintf("Rule \"%s\" changed to \"%s\"", old, query))
+	}
+
+	return handler
+}
+
+// Removes a rule from a channel
+func HandleAdminRemoveRule(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		c, ok := adminChannelConfig(env, w, r)
+		if !ok {
+			return
+		}
+
+		query := r.FormValue("query")
+		err := c.RemoveRule(query, env)
+		if err != nil {
+			adminRedirect(w, r, fmt.Sprintf("Error in deleting rule: %s", err.Error()))
+			return
+		}
+
+		adminRedirect(w, r, fmt.Sprintf("Rule \"%s\" removed", query))
+	}
+
+	return handler
+}
+
+// Shows which GPUs currently in the database a rule would notify about. A channel's saved rule is tested
+// with its filters, unless filters are given in the request as they are from the add rule form.
+func HandleAdminTestRule(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		c, ok := adminChannelConfig(env, w, r)
+		if !ok {
+			return
+		}
+
+		form := r.URL.Query()
+		rule, ok := c.Rule(r.FormValue("query"))
+		if !ok || form.Has("max_price") || form.Has("brand") || form.Has("event") {
+			var err error
+			rule, err = ruleFromForm(r)
+			if err == nil {
+				err = rule.Validate()
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		matches, err := QueryRule(env, rule)
+		if err != nil {
+			log.Println("error in route admin rule test: ", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// GPUs over the max price only notify once they drop to it, so they're listed separately
+		var overMaxPrice []*GPU
+		if rule.MaxPrice > 0 {
+			var under []*GPU
+			for _, gpu := range matches {
+				if gpu.Price > rule.MaxPrice {
+					overMaxPrice = append(overMaxPrice, gpu)
+				} else {
+					under = append(under, gpu)
+				}
+			}
+			matches = under
+		}
+
+		tmpl_data := map[string]any{
+			"Channel":      &AdminChannel{Name: env.DiscordBot.ChannelName(c.ChannelID), Config: c},
+			"Rule":         rule,
+			"GPUs":         matches,
+			"OverMaxPrice": overMaxPrice,
+		}
+		err = env.Templates.Render(w, "admin_test", tmpl_data)
+		if err != nil {
+			log.Println("error in route admin rule test: ", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	return handler
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// The raw data behind a scrape: the page that was fetched and what the scraper printed
+type ScrapePayload struct {
+	HTML   []byte
+	Output []byte
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(b)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// Compresses a payload into the run
+func (run *ScrapeRun) SetPayload(payload *ScrapePayload) error {
+	var err error
+	if len(payload.HTML) > 0 {
+		run.PayloadHTML, err = gzipBytes(payload.HTML)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(payload.Output) > 0 {
+		run.PayloadJSON, err = gzipBytes(payload.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decompresses the run's archived payload
+func (run *ScrapeRun) Payload() (*ScrapePayload, error) {
+	payload := &ScrapePayload{}
+
+	var err error
+	if len(run.PayloadHTML) > 0 {
+		payload.HTML, err = gunzipBytes(run.PayloadHTML)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress archived page: %s", err.Error())
+		}
+	}
+
+	if len(run.PayloadJSON) > 0 {
+		payload.Output, err = gunzipBytes(run.PayloadJSON)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress archived scraper output: %s", err.Error())
+		}
+	}
+
+	return payload, nil
+}
+
+// Clears the payloads of scrape runs older than retention.archive. The runs themselves are kept.
+func PruneScrapeArchives(ctx context.Context, env *Env) error {
+	cutoff := time.Now().Add(-time.Duration(env.Config.Retention.Archive))
+	result := env.DB.WithContext(ctx).Model(&ScrapeRun{}).
+		Where("started_at < ? AND (payload_html IS NOT NULL OR payload_json IS NOT NULL)", cutoff).
+		Updates(map[string]any{"payload_html": nil, "payload_json": nil})
+	if result.Error != nil {
+		return fmt.Errorf("error in pruning scrape archives: %s", result.Error)
+	}
+
+	if result.RowsAffected > 0 {
+		log.Printf("Cleared archived payloads of %d scrape runs\n", result.RowsAffected)
+	}
+
+	return nil
+}
+
+// Applies every retention policy: price history and scrape run archives
+func ApplyRetention(ctx context.Context, env *Env) error {
+	priceErr := ApplyPriceRetention(ctx, env)
+	archiveErr := PruneScrapeArchives(ctx, env)
+	if priceErr != nil {
+		return priceErr
+	}
+
+	return archiveErr
+}
+
+// Runs an archived scrape's page through the current scraper again, as if it had just been fetched
+func ReparseScrapeRun(ctx context.Context, run *ScrapeRun) (*ScrapeData, error) {
+	payload, err := run.Payload()
+	if err != nil {
+		return nil, err
+	}
+	if len(payload.HTML) == 0 {
+		return nil, fmt.Errorf("scrape run %d has no archived page", run.ID)
+	}
+
+	htmlFile, err := os.CreateTemp("", "gpubud-reparse-*.html")
+	if err != nil {
+		return nil, fmt.Errorf("could not write archived page: %s", err.Error())
+	}
+	defer os.Remove(htmlFile.Name())
+
+	_, err = htmlFile.Write(payload.HTML)
+	htmlFile.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not write archived page: %s", err.Error())
+	}
+
+	cmd := exec.CommandContext(ctx, "python3", "./scrapers/scrape_microcenter.py", "-s", run.Source, "--html-in", htmlFile.Name())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("scraper failed on archived page: %s\n%s", err.Error(), out)
+	}
+
+	return parseScraperOutput(out)
+}
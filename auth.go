@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	sessionCookieName = "gpubud_session"
+	sessionDuration   = 7 * 24 * time.Hour
+	apiTokenPrefix    = "gpb_"
+	// Holds the CSRF token for the login form, since there is no session to keep it in yet
+	loginCSRFCookieName = "gpubud_login_csrf"
+	loginCSRFDuration   = time.Hour
+)
+
+// Scopes that can be granted to API tokens
+const (
+	ScopeGPUsRead = "gpus:read"
+	ScopeAdmin    = "admin"
+)
+
+var apiScopes = []string{ScopeGPUsRead, ScopeAdmin}
+
+// Compared against when a login names an unknown user so it takes as long as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("gpubud"), bcrypt.DefaultCost)
+
+// A person who can log in to the web server
+type User struct {
+	gorm.Model
+	Username     string `gorm:"unique;not null"`
+	PasswordHash string `gorm:"not null"`
+	IsAdmin      bool   `gorm:"default:false"`
+}
+
+// A logged in browser session. Only a hash of the session token is stored, the token itself lives in the
+// user's cookie.
+type Session struct {
+	gorm.Model
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	CSRFToken string `gorm:"not null"`
+	UserID    uint
+	User      *User
+	ExpiresAt time.Time
+}
+
+// A long lived bearer token for /api clients. Only a hash of the token is stored.
+type APIToken struct {
+	gorm.Model
+	Name       string `gorm:"not null"`
+	TokenHash  string `gorm:"uniqueIndex;not null"`
+	Scopes     string
+	UserID     uint
+	User       *User
+	LastUsedAt *time.Time
+}
+
+type contextKey string
+
+const (
+	userContextKey    contextKey = "user"
+	sessionContextKey contextKey = "session"
+)
+
+// Reports whether the token was granted a scope. The admin scope implies every other scope.
+func (t *APIToken) HasScope(scope string) bool {
+	scopes := strings.Split(t.Scopes, ",")
+	return slices.Contains(scopes, scope) || slices.Contains(scopes, ScopeAdmin)
+}
+
+// Generates a random hex string from n random bytes
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("could not generate token: %s", err.Error())
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Hashes a session or API token for storage. Tokens are high entropy so a fast hash is sufficient.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a new user with a bcrypt hashed password
+func CreateUser(env *Env, username string, password string, isAdmin bool) (*User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+	if len(password) < 8 {
+		return nil, fmt.Errorf("password must be at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash password: %s", err.Error())
+	}
+
+	user := &User{
+		Username:     username,
+		PasswordHash: string(hash),
+		IsAdmin:      isAdmin,
+	}
+
+	result := env.DB.Create(user)
+	if result.Error != nil {
+		return nil, fmt.Errorf("could not create user: %s", result.Error)
+	}
+
+	return user, nil
+}
+
+// Checks a username and password, returning the user if they match
+func AuthenticateUser(env *Env, username string, password string) (*User, error) {
+	var user User
+	result := env.DB.First(&user, "username = ?", username)
+	if result.Error != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, fmt.Errorf("invalid username or password")
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+
+	return &user, nil
+}
+
+// Creates a new session for a user and returns the raw session token to put in the cookie
+func CreateSession(env *Env, user *User) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	csrf, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	session := &Session{
+		TokenHash: hashToken(token),
+		CSRFToken: csrf,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(sessionDuration),
+	}
+
+	result := env.DB.Create(session)
+	if result.Error != nil {
+		return "", fmt.Errorf("could not create session: %s", result.Error)
+	}
+
+	// Clean up any sessions that have expired while we're here
+	env.DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&Session{})
+
+	return token, nil
+}
+
+// Finds the unexpired session for a raw session token
+func FindSession(env *Env, token string) (*Session, error) {
+	var session Session
+	result := env.DB.Preload("User").First(&session, "token_hash = ? AND expires_at > ?", hashToken(token), time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &session, nil
+}
+
+// Deletes the session for a raw session token
+func DeleteSession(env *Env, token string) error {
+	result := env.DB.Unscoped().Where("token_hash = ?", hashToken(token)).Delete(&Session{})
+	if result.Error != nil {
+		return fmt.Errorf("could not delete session: %s", result.Error)
+	}
+
+	return nil
+}
+
+// Creates an API token for a user with the given scopes and returns the raw token. The raw token cannot
+// be recovered later, so it must be shown to the user right away.
+func CreateAPIToken(env *Env, user *User, name string, scopes []string) (string, error) {
+	for _, scope := range scopes {
+		if !slices.Contains(apiScopes, scope) {
+			return "", fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + secret
+
+	apiToken := &APIToken{
+		Name:      name,
+		TokenHash: hashToken(token),
+		Scopes:    strings.Join(scopes, ","),
+		UserID:    user.ID,
+	}
+
+	result := env.DB.Create(apiToken)
+	if result.Error != nil {
+		return "", fmt.Errorf("could not create api token: %s", result.Error)
+	}
+
+	return token, nil
+}
+
+// Finds the API token record for a raw bearer token and records that it was used
+func FindAPIToken(env *Env, token string) (*APIToken, error) {
+	var apiToken APIToken
+	result := env.DB.Preload("User").First(&apiToken, "token_hash = ?", hashToken(token))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	now := time.Now()
+	env.DB.Model(&apiToken).Update("last_used_at", now)
+
+	return &apiToken, nil
+}
+
+// Gets the logged in user for a request that has passed through RequireAdmin
+func CurrentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// Gets the CSRF token of the current session for embedding in forms
+func CSRFToken(r *http.Request) string {
+	session, _ := r.Context().Value(sessionContextKey).(*Session)
+	if session == nil {
+		return ""
+	}
+
+	return session.CSRFToken
+}
+
+// Wraps a handler so it can only be reached by a logged in admin. Requests that change state must carry
+// the session's CSRF token in a csrf_token form value or X-CSRF-Token header.
+func RequireAdmin(env *Env, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var session *Session
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			session, _ = FindSession(env, cookie.Value)
+		}
+
+		if session == nil || session.User == nil {
+			if r.Method == http.MethodGet {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !session.User.IsAdmin {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			token := r.Header.Get("X-CSRF-Token")
+			if token == "" {
+				token = r.FormValue("csrf_token")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, session.User)
+		ctx = context.WithValue(ctx, sessionContextKey, session)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// Wraps an /api handler so it can only be reached with a bearer token that has the given scope
+func RequireScope(env *Env, scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !strings.HasPrefix(token, apiTokenPrefix) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gpubud"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		apiToken, err := FindAPIToken(env, token)
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Println("error in api authentication: ", err.Error())
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gpubud", error="invalid_token"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !apiToken.HasScope(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="gpubud", error="insufficient_scope", scope="%s"`, scope))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, apiToken.User)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// Only allow redirects after login to local paths
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/admin/"
+	}
+
+	return next
+}
+
+// Gets the login form's CSRF token from its cookie, or sets a new one
+func loginCSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(loginCSRFCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCSRFCookieName,
+		Value:    token,
+		Path:     "/login",
+		Expires:  time.Now().Add(loginCSRFDuration),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return token, nil
+}
+
+// Reports whether a form's csrf_token value matches the expected token
+func validCSRFToken(r *http.Request, expected string) bool {
+	token := r.FormValue("csrf_token")
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// Shows the login form
+func HandleLoginPage(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		csrf, err := loginCSRFToken(w, r)
+		if err != nil {
+			log.Println("error in route login: ", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tmpl_data := map[string]any{
+			"Next":      safeRedirect(r.URL.Query().Get("next")),
+			"CSRFToken": csrf,
+		}
+		err = env.Templates.Render(w, "login", tmpl_data)
+		if err != nil {
+			log.Println("error in route login: ", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	return handler
+}
+
+// Checks the submitted credentials and starts a session. The form must carry the CSRF token from the
+// login cookie, so other sites can't log a browser in to an account of their choosing.
+func HandleLogin(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		next := safeRedirect(r.FormValue("next"))
+
+		cookie, err := r.Cookie(loginCSRFCookieName)
+		if err != nil || !validCSRFToken(r, cookie.Value) {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+
+		user, err := AuthenticateUser(env, r.FormValue("username"), r.FormValue("password"))
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			tmpl_data := map[string]any{
+				"Next":      next,
+				"Error":     err.Error(),
+				"CSRFToken": cookie.Value,
+			}
+			err = env.Templates.Render(w, "login", tmpl_data)
+			if err != nil {
+				log.Println("error in route login: ", err.Error())
+			}
+			return
+		}
+
+		token, err := CreateSession(env, user)
+		if err != nil {
+			log.Println("error in route login: ", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The login token is only good for one login
+		http.SetCookie(w, &http.Cookie{
+			Name:     loginCSRFCookieName,
+			Value:    "",
+			Path:     "/login",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    token,
+			Path:     "/",
+			Expires:  time.Now().Add(sessionDuration),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+
+	return handler
+}
+
+// Ends the current session. The form must carry the session's CSRF token, so other sites can't log the
+// browser out.
+func HandleLogout(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			if session, err := FindSession(env, cookie.Value); err == nil {
+				if !validCSRFToken(r, session.CSRFToken) {
+					http.Error(w, "invalid csrf token", http.StatusForbidden)
+					return
+				}
+
+				err = DeleteSession(env, cookie.Value)
+				if err != nil {
+					log.Println("error in route logout: ", err.Error())
+				}
+			}
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+
+	return handler
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A notification a rule would have sent
+type BacktestHit struct {
+	Time time.Time
+	GPU  *GPU
+	Diff *GPUDifference
+}
+
+// The notifications a rule would have sent over a window of time
+type BacktestResult struct {
+	Rule  *ChannelConfigRule
+	Since time.Time
+	Until time.Time
+	// Number of GPUs the rule matches
+	Matched int
+	// Oldest first
+	Hits []*BacktestHit
+}
+
+// Replays the stored price history of every GPU matching rule and finds each change that would have
+// triggered a notification between since and until. Like the notifier, a GPU's first appearance counts
+// as a change from nothing.
+func Backtest(env *Env, rule *ChannelConfigRule, since, until time.Time) (*BacktestResult, error) {
+	rule.Query = strings.TrimSpace(rule.Query)
+	err := rule.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	gpus, err := QueryRule(env, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BacktestResult{Rule: rule, Since: since, Until: until, Matched: len(gpus)}
+	for _, gpu := range gpus {
+		history, err := PriceHistory(env, gpu.ID, since, until)
+		if err != nil {
+			return nil, err
+		}
+
+		var prev *PricePoint
+		for _, point := range history {
+			diff := &GPUDifference{GPUID: gpu.ID, GPU: gpu, PriceNew: point.Price, StockNew: point.Stock}
+			if prev != nil {
+				diff.PriceOld = prev.Price
+				diff.StockOld = prev.Stock
+			}
+			diff.IsDiff = diff.PriceNew != diff.PriceOld || diff.StockNew != diff.StockOld
+			if rule.Triggers(diff) && !point.Time.Before(since) {
+				result.Hits = append(result.Hits, &BacktestHit{Time: point.Time, GPU: gpu, Diff: diff})
+			}
+			prev = point
+		}
+	}
+
+	slices.SortFunc(result.Hits, func(a, b *BacktestHit) int {
+		return a.Time.Compare(b.Time)
+	})
+
+	return result, nil
+}
+
+// Describes a hit on one line, such as "ASUS NVIDIA RTX 4070 Dual: $599 -> $549, stock 0 -> 3"
+func (hit *BacktestHit) String() string {
+	var changes []string
+	if hit.Diff.PriceOld != hit.Diff.PriceNew {
+		changes = append(changes, fmt.Sprintf("$%.2f -> $%.2f", hit.Diff.PriceOld, hit.Diff.PriceNew))
+	}
+	if hit.Diff.StockOld != hit.Diff.StockNew {
+		changes = append(changes, fmt.Sprintf("stock %d -> %d", hit.Diff.StockOld, hit.Diff.StockNew))
+	}
+
+	gpu := hit.GPU
+	return fmt.Sprintf("%s %s %s %s: %s", gpu.Manufacturer, gpu.Brand, strings.TrimSpace(gpu.Line), gpu.ProductModel, strings.Join(changes, ", "))
+}
+
+// A few lines describing the result, short enough for a Discord message
+func (r *BacktestResult) Summary(recent int) string {
+	days := int(r.Until.Sub(r.Since).Round(24*time.Hour) / (24 * time.Hour))
+	if r.Matched == 0 {
+		return fmt.Sprintf("%s doesn't match any GPUs yet, so it wouldn't have sent anything in the last %d days", r.Rule, days)
+	}
+
+	summary := fmt.Sprintf("%s matches %d GPUs and would have sent %d notifications in the last %d days", r.Rule, r.Matched, len(r.Hits), days)
+	if len(r.Hits) == 0 {
+		return summary
+	}
+
+	summary += ". Most recent:"
+	for _, hit := range r.Hits[max(0, len(r.Hits)-recent):] {
+		summary += fmt.Sprintf("\n<t:%d:R> %s", hit.Time.Unix(), hit)
+	}
+
+	return summary
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Scheduled backups are named gpubud-<timestamp>.db, with .gz added when compressed
+const (
+	backupPrefix     = "gpubud-"
+	backupTimeFormat = "20060102-150405"
+)
+
+// Writes a consistent copy of the SQLite database to path with VACUUM INTO, which is safe to run while
+// the database is being written to. The copy is gzip compressed if compress is set, in which case .gz is
+// added to path. Returns the path written.
+func BackupDatabase(ctx context.Context, env *Env, path string, compress bool) (string, error) {
+	if env.Config.Database.Driver != DriverSQLite {
+		return "", fmt.Errorf("backups are only supported for sqlite databases, use pg_dump for postgres")
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return "", fmt.Errorf("could not create backup directory: %s", err.Error())
+	}
+
+	result := env.DB.WithContext(ctx).Exec("VACUUM INTO ?", path)
+	if result.Error != nil {
+		return "", fmt.Errorf("could not back up database: %s", result.Error)
+	}
+
+	if !compress {
+		return path, nil
+	}
+
+	compressed := path + ".gz"
+	err = gzipFile(path, compressed)
+	os.Remove(path)
+	if err != nil {
+		os.Remove(compressed)
+		return "", fmt.Errorf("could not compress backup: %s", err.Error())
+	}
+
+	return compressed, nil
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+func gunzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, r)
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// Deletes the oldest scheduled backups in dir so that only keep remain
+func RotateBackups(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not list backups: %s", err.Error())
+	}
+
+	// The timestamp in the name sorts oldest first
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, backupPrefix) && (strings.HasSuffix(name, ".db") || strings.HasSuffix(name, ".db.gz")) {
+			backups = append(backups, name)
+		}
+	}
+	slices.Sort(backups)
+
+	for len(backups) > keep {
+		err := os.Remove(filepath.Join(dir, backups[0]))
+		if err != nil {
+			return fmt.Errorf("could not delete old backup: %s", err.Error())
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// Backs up the database into backup.dir and deletes old backups beyond backup.keep
+func ScheduledBackup(ctx context.Context, env *Env) error {
+	cfg := env.Config.Backup
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + ".db"
+
+	path, err := BackupDatabase(ctx, env, filepath.Join(cfg.Dir, name), cfg.Gzip)
+	if err != nil {
+		return err
+	}
+	log.Printf("Backed up database to %s\n", path)
+
+	return RotateBackups(cfg.Dir, cfg.Keep)
+}
+
+// Replaces the SQLite database at dbPath with a backup. The backup is checked for corruption and must not
+// have a newer schema than this build; older schemas are migrated before the swap. The current database
+// is kept next to it as <name>.pre-restore-<timestamp>. Returns the path of that copy, if there was one.
+// gpubud must not be running against the database while it is restored.
+func RestoreDatabase(backup, dbPath string) (string, error) {
+	// Stage the restored database next to the real one so the final rename doesn't cross filesystems
+	staged := dbPath + ".restoring"
+	os.Remove(staged)
+	defer os.Remove(staged)
+
+	var err error
+	if strings.HasSuffix(backup, ".gz") {
+		err = gunzipFile(backup, staged)
+	} else {
+		err = copyFile(backup, staged)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read backup: %s", err.Error())
+	}
+
+	err = checkRestoredDatabase(staged)
+	if err != nil {
+		return "", err
+	}
+
+	previous := ""
+	if _, err := os.Stat(dbPath); err == nil {
+		previous = dbPath + ".pre-restore-" + time.Now().UTC().Format(backupTimeFormat)
+		err = os.Rename(dbPath, previous)
+		if err != nil {
+			return "", fmt.Errorf("could not move current database aside: %s", err.Error())
+		}
+	}
+
+	// Journal files belong to the database that was moved aside and must not be applied to the restored one
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if _, err := os.Stat(dbPath + suffix); err == nil && previous != "" {
+			os.Rename(dbPath+suffix, previous+suffix)
+		}
+	}
+
+	err = os.Rename(staged, dbPath)
+	if err != nil {
+		return previous, fmt.Errorf("could not move restored database into place: %s", err.Error())
+	}
+
+	return previous, nil
+}
+
+// Opens a staged database, checks its integrity and schema version and brings its schema up to date
+func checkRestoredDatabase(path string) error {
+	DB, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return fmt.Errorf("could not open backup: %s", err.Error())
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return fmt.Errorf("could not open backup: %s", err.Error())
+	}
+	defer sqlDB.Close()
+
+	var check string
+	result := DB.Raw("PRAGMA integrity_check").Scan(&check)
+	if result.Error != nil {
+		return fmt.Errorf("could not check backup: %s", result.Error)
+	}
+	if check != "ok" {
+		return fmt.Errorf("backup is corrupt: %s", check)
+	}
+
+	if !DB.Migrator().HasTable("gpus") {
+		return fmt.Errorf("backup is not a gpubud database")
+	}
+
+	version, err := SchemaVersion(DB)
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("backup has schema version %d but this build only supports up to version %d", version, LatestSchemaVersion())
+	}
+
+	err = MigrateDatabase(DB)
+	if err != nil {
+		return fmt.Errorf("could not migrate backup from schema version %d: %s", version, err.Error())
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
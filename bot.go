@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -12,6 +19,14 @@ import (
 type DiscordBot struct {
 	session *discordgo.Session
 	config  *DiscordBotConfig
+	// Guards config.NotifierChannels, which is shared between Discord interactions and the web server
+	channelsMu sync.RWMutex
+	// Whether the gateway websocket is currently connected
+	connected atomic.Bool
+	// Tracks notifications being sent in the background so they can be flushed on shutdown
+	notifying    sync.WaitGroup
+	notifyCtx    context.Context
+	notifyCancel context.CancelFunc
 }
 
 type DiscordBotConfig struct {
@@ -23,6 +38,66 @@ type DiscordBotConfig struct {
 	Env *Env
 }
 
+// The message text sent with GPU update notifications
+const notificationContent = "A GPU you are tracking has been updated!"
+
+// Permission required to see and use operator commands
+var adminPermission int64 = discordgo.PermissionAdministrator
+
+// Commands only the users in discord.operators can use, on top of any permission Discord checks
+var operatorCommands = map[string]bool{"jobs": true}
+
+// Range and default of the backtest command's days option
+var backtestMinDays float64 = 1
+
+const (
+	backtestMaxDays     = 365
+	backtestDefaultDays = 30
+	// Number of recent notifications listed in a backtest summary
+	backtestSummaryHits = 5
+)
+
+// Bounds of the max price option of rule commands
+var ruleMinPrice float64 = 0
+
+// Options that narrow down which changes a rule notifies about, shared by add-rule and backtest
+var ruleFilterOptions = []*discordgo.ApplicationCommandOption{
+	{
+		Type:        discordgo.ApplicationCommandOptionNumber,
+		Name:        "max-price",
+		Description: "Only notify when the price is at or below this",
+		MinValue:    &ruleMinPrice,
+	},
+	{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "brand",
+		Description: "Only match GPUs of this brand",
+		Choices: []*discordgo.ApplicationCommandOptionChoice{
+			{Name: "NVIDIA", Value: "NVIDIA"},
+			{Name: "AMD", Value: "AMD"},
+			{Name: "Intel", Value: "Intel"},
+		},
+	},
+	{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "event",
+		Description: "Which changes to notify about (default any)",
+		Choices: []*discordgo.ApplicationCommandOptionChoice{
+			{Name: "Any price or stock change", Value: RuleEventAny},
+			{Name: "Price drops", Value: RuleEventPriceDrop},
+			{Name: "Back in stock", Value: RuleEventRestock},
+		},
+	},
+}
+
+// The job name option shared by the jobs subcommands
+var jobNameOption = &discordgo.ApplicationCommandOption{
+	Type:        discordgo.ApplicationCommandOptionString,
+	Name:        "job",
+	Description: "Name of the job",
+	Required:    true,
+}
+
 var commands = []*discordgo.ApplicationCommand{
 	{
 		Name:        "subscribe",
@@ -38,7 +113,16 @@ var commands = []*discordgo.ApplicationCommand{
 	},
 	{
 		Name:        "add-rule",
-		Description: "Create a new rule for GPU Bud to send notifications",
+		Description: "Create a new rule for GPU Bud to send notifications. Leave out the query to use a form.",
+		Options: append([]*discordgo.ApplicationCommandOption{
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "query",
+				Description:  "The GPU model or other text to match, such as 4070 Ti",
+				MaxLength:    maxRuleQueryLength,
+				Autocomplete: true,
+			},
+		}, ruleFilterOptions...),
 	},
 	{
 		Name:        "remove-rule",
@@ -48,11 +132,111 @@ var commands = []*discordgo.ApplicationCommand{
 		Name:        "list",
 		Description: "Lists all the currently in stock GPUs",
 	},
+	{
+		Name:        "price",
+		Description: "Shows the current price, stock and recent price history of matching GPUs",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "query",
+				Description:  "A GPU model, such as 4070 Ti, or a GPU ID",
+				Required:     true,
+				MaxLength:    maxRuleQueryLength,
+				Autocomplete: true,
+			},
+		},
+	},
+	{
+		Name:        "backtest",
+		Description: "Shows the notifications a rule would have sent recently",
+		Options: append([]*discordgo.ApplicationCommandOption{
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "query",
+				Description:  "The GPU model or other text the rule would match",
+				Required:     true,
+				MaxLength:    maxRuleQueryLength,
+				Autocomplete: true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "days",
+				Description: "How many days back to look (default 30)",
+				MinValue:    &backtestMinDays,
+				MaxValue:    backtestMaxDays,
+			},
+		}, ruleFilterOptions...),
+	},
+	{
+		Name:                     "jobs",
+		Description:              "View and control GPU Bud's background jobs",
+		DefaultMemberPermissions: &adminPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "Lists every job with its last run and next run",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "run",
+				Description: "Runs a job now",
+				Options:     []*discordgo.ApplicationCommandOption{jobNameOption},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "pause",
+				Description: "Stops a job from running on its schedule",
+				Options:     []*discordgo.ApplicationCommandOption{jobNameOption},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "resume",
+				Description: "Lets a paused job run on its schedule again",
+				Options:     []*discordgo.ApplicationCommandOption{jobNameOption},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "interval",
+				Description: "Changes how often a job runs",
+				Options: []*discordgo.ApplicationCommandOption{
+					jobNameOption,
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "every",
+						Description: "How often to run the job, at least 1m, such as 10m or 1h",
+						Required:    true,
+					},
+				},
+			},
+		},
+	},
 }
 
 var commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot){
 	"help": func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
-		// TODO: Write help function. This function will give a more detailed explanation of the commands the bot offers
+		embed := HelpOverviewEmbed()
+		content := ""
+		for _, option := range i.ApplicationCommandData().Options {
+			if option.Name != "command" {
+				continue
+			}
+
+			if command, ok := findCommand(option.StringValue()); ok {
+				embed = CommandHelpEmbed(command)
+			} else {
+				content = fmt.Sprintf("There is no command called `%s`", option.StringValue())
+			}
+		}
+
+		Respond(s, i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Embeds:  []*discordgo.MessageEmbed{embed},
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
 	},
 
 	"subscribe": func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
@@ -64,7 +248,7 @@ var commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.Interac
 		content := ""
 		stop := false
 
-		if c, ok := b.config.NotifierChannels[i.ChannelID]; ok {
+		if c, ok := b.ChannelConfig(i.ChannelID); ok {
 			// We have the current channel in the configuration already
 			err := c.Subscribe(b.config.Env)
 			if err != nil {
@@ -86,7 +270,7 @@ var commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.Interac
 			if subscribeErr != nil && !stop {
 				content = fmt.Sprintf("Could not subscribe: %s", err.Error())
 			} else if subscribeErr == nil && !stop {
-				b.config.NotifierChannels[channel.ID] = newConfig
+				b.SetChannelConfig(newConfig)
 				content = "Subscribed for notifications"
 			}
 		}
@@ -106,7 +290,7 @@ var commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.Interac
 		content := ""
 		stop := false
 
-		if c, ok := b.config.NotifierChannels[i.ChannelID]; ok {
+		if c, ok := b.ChannelConfig(i.ChannelID); ok {
 			err := c.Unsubscribe(b.config.Env)
 			if err != nil {
 				content = fmt.Sprintf("Could not unsubscribe: %s", err.Error())
@@ -134,11 +318,11 @@ var commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.Interac
 	"rules": func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
 		content := ""
 
-		if c, ok := b.config.NotifierChannels[i.ChannelID]; ok {
+		if c, ok := b.ChannelConfig(i.ChannelID); ok {
 			content = "Rules for current channel: "
 			var sb strings.Builder
-			for _, r := range c.Rules {
-				sb.WriteString(fmt.Sprintf("`%s` ", r.Query))
+			for _, r := range c.CurrentRules() {
+				sb.WriteString(r.String() + " ")
 			}
 
 			content = content + sb.String()
@@ -158,40 +342,45 @@ var commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.Interac
 	},
 
 	"add-rule": func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
-		response := &discordgo.InteractionResponse{
-			Type: discordgo.InteractionResponseModal,
-			Data: &discordgo.InteractionResponseData{
-				CustomID: "ar_submit",
-				Title:    "New Rule",
-				Flags:    discordgo.MessageFlagsEphemeral,
-				Components: []discordgo.MessageComponent{
-					discordgo.ActionsRow{
-						Components: []discordgo.MessageComponent{
-							discordgo.TextInput{
-								Label:       "GPU Model to get updates for",
-								Style:       discordgo.TextInputShort,
-								Placeholder: "Model...",
-								MinLength:   1,
-								MaxLength:   16,
-								Required:    true,
-							},
-						},
-					},
-				},
-			},
+		rule := &ChannelConfigRule{}
+		for _, option := range i.ApplicationCommandData().Options {
+			switch option.Name {
+			case "query":
+				rule.Query = option.StringValue()
+			case "max-price":
+				rule.MaxPrice = option.FloatValue()
+			case "brand":
+				rule.Brand = option.StringValue()
+			case "event":
+				rule.Event = option.StringValue()
+			}
 		}
 
-		Respond(s, i, response)
+		// Without a query the rule is entered in a form, filled in with any options that were given
+		if strings.TrimSpace(rule.Query) == "" {
+			Respond(s, i, addRuleModal(rule))
+			return
+		}
+
+		Respond(s, i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: addRule(b, i.ChannelID, rule),
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
 	},
 
 	"remove-rule": func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
 		var options []discordgo.SelectMenuOption
 
-		if c, ok := b.config.NotifierChannels[i.ChannelID]; ok {
-			for _, r := range c.Rules {
+		if c, ok := b.ChannelConfig(i.ChannelID); ok {
+			for _, r := range c.CurrentRules() {
+				// Values are kept short, since the chosen one ends up in the confirmation buttons' custom IDs
 				opt := discordgo.SelectMenuOption{
-					Label: r.Query,
-					Value: r.Query,
+					Label:       r.Query,
+					Value:       strconv.Itoa(int(r.ID)),
+					Description: r.Filters(),
 					Emoji: &discordgo.ComponentEmoji{
 						Name: "🗑️",
 					},
@@ -235,6 +424,46 @@ var commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.Interac
 		Respond(s, i, response)
 	},
 
+	"jobs": handleJobsCommand,
+
+	"backtest": func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
+		rule := &ChannelConfigRule{}
+		days := int64(backtestDefaultDays)
+		for _, option := range i.ApplicationCommandData().Options {
+			switch option.Name {
+			case "query":
+				rule.Query = option.StringValue()
+			case "days":
+				days = option.IntValue()
+			case "max-price":
+				rule.MaxPrice = option.FloatValue()
+			case "brand":
+				rule.Brand = option.StringValue()
+			case "event":
+				rule.Event = option.StringValue()
+			}
+		}
+
+		content := ""
+		now := time.Now()
+		result, err := Backtest(b.config.Env, rule, now.AddDate(0, 0, -int(days)), now)
+		if err != nil {
+			content = fmt.Sprintf("Error in running backtest: %s", err.Error())
+		} else {
+			content = result.Summary(backtestSummaryHits)
+		}
+
+		Respond(s, i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+	},
+
+	"price": handlePriceCommand,
+
 	"list": func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
 		gpus, err := GetAllGPUs(b.config.Env)
 		if err != nil {
@@ -278,14 +507,278 @@ var commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.Interac
 	},
 }
 
+// Longest name Discord accepts for an option choice
+const maxChoiceNameLength = 100
+
+// Handlers for commands with autocompleted options, keyed by command name
+var autocompleteHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot){
+	"add-rule": autocompleteRuleQuery,
+	"backtest": autocompleteRuleQuery,
+	"price":    autocompleteRuleQuery,
+}
+
+// Suggests models, lines and brands for a command's query option as the user types, showing how many
+// GPUs each would match. A brand already chosen in the command narrows the suggestions.
+func autocompleteRuleQuery(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
+	text := ""
+	brand := ""
+	for _, option := range i.ApplicationCommandData().Options {
+		switch option.Name {
+		case "query":
+			text = option.StringValue()
+		case "brand":
+			brand = option.StringValue()
+		}
+	}
+
+	suggestions, err := SuggestQueries(b.config.Env, text, brand, maxSuggestions)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	for _, suggestion := range suggestions {
+		name := suggestion.String()
+		if len(name) > maxChoiceNameLength {
+			name = suggestion.Value
+		}
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  name,
+			Value: suggestion.Value,
+		})
+	}
+
+	// Autocomplete responses can't fall back to a message, so errors are only logged
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	if err != nil {
+		log.Printf("Could not respond to autocomplete %s: %s\n", i.ID, err.Error())
+	}
+}
+
+// Handles the price command, which shows the GPUs matching a query with their 30 day low and high and a
+// chart of their recent prices
+func handlePriceCommand(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
+	respond := func(content string) {
+		Respond(s, i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+	}
+
+	query := i.ApplicationCommandData().Options[0].StringValue()
+	until := time.Now()
+	since := until.AddDate(0, 0, -priceLookupDays)
+	summaries, total, err := LookupPrices(b.config.Env, query, since, until, maxPriceListings)
+	if err != nil {
+		respond(fmt.Sprintf("Error in looking up prices: %s", err.Error()))
+		return
+	}
+	if len(summaries) == 0 {
+		respond(fmt.Sprintf("No GPUs match `%s`", query))
+		return
+	}
+
+	var embeds []*discordgo.MessageEmbed
+	for n, summary := range summaries {
+		gpu := summary.GPU
+		embeds = append(embeds, &discordgo.MessageEmbed{
+			URL:   gpu.Link,
+			Title: fmt.Sprintf("%s %s %s %s", gpu.Manufacturer, gpu.Brand, gpu.Line, gpu.ProductModel),
+			Description: fmt.Sprintf("%s $%v - %v in stock at Microcenter\n%d day low $%v, high $%v",
+				chartSeries[n].Emoji, gpu.Price, gpu.Stock, priceLookupDays, summary.Low, summary.High),
+			Color:  brandColor(gpu.Brand),
+			Footer: &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("ID %d", gpu.ID)},
+		})
+	}
+
+	content := fmt.Sprintf("GPUs matching `%s`:", query)
+	if total > len(summaries) {
+		content = fmt.Sprintf("Showing %d of the %d GPUs matching `%s`:", len(summaries), total, query)
+	}
+
+	data := &discordgo.InteractionResponseData{
+		Content: content,
+		Embeds:  embeds,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	}
+
+	chart, err := RenderPriceChart(summaries, since, until)
+	if err != nil {
+		// The listings are still worth showing without the chart
+		log.Println(err.Error())
+	} else {
+		data.Files = []*discordgo.File{{Name: "prices.png", ContentType: "image/png", Reader: bytes.NewReader(chart)}}
+		data.Embeds = append(data.Embeds, &discordgo.MessageEmbed{
+			Title: fmt.Sprintf("Prices over the last %d days", priceLookupDays),
+			Image: &discordgo.MessageEmbedImage{URL: "attachment://prices.png"},
+		})
+	}
+
+	Respond(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: data,
+	})
+}
+
+// Handles the jobs command, which lets server admins list, run, pause, resume and reschedule UpdateManager jobs
+func handleJobsCommand(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
+	respond := func(content string, embeds ...*discordgo.MessageEmbed) {
+		Respond(s, i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Embeds:  embeds,
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+	}
+
+	// Jobs affect every server the bot is in, so being an admin of one isn't enough
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+	if user == nil || !b.config.Env.Config.Discord.IsOperator(user.ID) {
+		respond("Only the bot's operators can manage jobs. Operators are listed by Discord user ID in discord.operators.")
+		return
+	}
+
+	um := b.config.Env.UpdateManager
+	sub := i.ApplicationCommandData().Options[0]
+	options := make(map[string]string)
+	for _, opt := range sub.Options {
+		options[opt.Name] = opt.StringValue()
+	}
+	job := options["job"]
+
+	var err error
+	switch sub.Name {
+	case "list":
+		respond("Jobs:", JobStatusEmbeds(um.Status())...)
+		return
+	case "run":
+		err = um.Trigger(job)
+		if err == nil {
+			respond(fmt.Sprintf("Started job `%s` ✅", job))
+			return
+		}
+	case "pause":
+		err = um.SetPaused(job, true)
+		if err == nil {
+			respond(fmt.Sprintf("Paused job `%s` ⏸️", job))
+			return
+		}
+	case "resume":
+		err = um.SetPaused(job, false)
+		if err == nil {
+			respond(fmt.Sprintf("Resumed job `%s` ▶️", job))
+			return
+		}
+	case "interval":
+		var d time.Duration
+		d, err = time.ParseDuration(options["every"])
+		if err == nil {
+			err = um.SetInterval(job, d)
+		}
+		if err == nil {
+			respond(fmt.Sprintf("Job `%s` now runs every %s ✅", job, d))
+			return
+		}
+	}
+
+	respond(fmt.Sprintf("Could not %s job: %s", sub.Name, err.Error()))
+}
+
+// Builds one embed per job describing its schedule and last result
+func JobStatusEmbeds(statuses []JobStatus) []*discordgo.MessageEmbed {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("<t:%d:R>", t.Unix())
+	}
+
+	var embeds []*discordgo.MessageEmbed
+	for _, status := range statuses {
+		result := "✅ success"
+		color := 1433088
+		if status.LastRun.IsZero() {
+			result = "not run yet"
+			color = 0
+		} else if status.LastError != "" {
+			result = fmt.Sprintf("❌ %s", status.LastError)
+			color = 16711680
+		}
+		if status.Running {
+			result = "⏳ running"
+		}
+
+		schedule := status.Schedule
+		if len(status.After) > 0 {
+			schedule = strings.TrimSpace(fmt.Sprintf("%s after %s", schedule, strings.Join(status.After, ", ")))
+		}
+		if status.Paused {
+			schedule = schedule + " (paused)"
+		}
+
+		next := formatTime(status.NextRun)
+		if status.Paused || status.NextRun.IsZero() {
+			next = "-"
+		}
+
+		embeds = append(embeds, &discordgo.MessageEmbed{
+			Title: status.Name,
+			Color: color,
+			Fields: []*discordgo.MessageEmbedField{
+				{Name: "Schedule", Value: schedule, Inline: true},
+				{Name: "Last run", Value: formatTime(status.LastRun), Inline: true},
+				{Name: "Duration", Value: status.LastDuration.Round(time.Millisecond).String(), Inline: true},
+				{Name: "Result", Value: result, Inline: true},
+				{Name: "Next run", Value: next, Inline: true},
+			},
+		})
+	}
+
+	return embeds
+}
+
 var componentHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot){
 	"remove_rule": func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
 		data := i.MessageComponentData()
+		id := data.Values[0]
+
+		description := ""
+		if c, ok := b.ChannelConfig(i.ChannelID); ok {
+			for _, rule := range c.CurrentRules() {
+				if strconv.Itoa(int(rule.ID)) == id {
+					description = rule.String()
+					break
+				}
+			}
+		}
+		if description == "" {
+			Respond(s, i, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseUpdateMessage,
+				Data: &discordgo.InteractionResponseData{
+					Content: "That rule no longer exists",
+					Flags:   discordgo.MessageFlagsEphemeral,
+				},
+			})
+			return
+		}
 
 		response := &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseUpdateMessage,
 			Data: &discordgo.InteractionResponseData{
-				Content: fmt.Sprintf("⚠️ Are you sure you want to remove this rule? ⚠️\n`%s`", data.Values[0]),
+				Content: fmt.Sprintf("⚠️ Are you sure you want to remove this rule? ⚠️\n%s", description),
 				Flags:   discordgo.MessageFlagsEphemeral,
 				Components: []discordgo.MessageComponent{
 					discordgo.ActionsRow{
@@ -294,13 +787,13 @@ var componentHandlers = map[string]func(s *discordgo.Session, i *discordgo.Inter
 								Label:    "Yes",
 								Style:    discordgo.PrimaryButton,
 								Disabled: false,
-								CustomID: fmt.Sprintf("remove_rule_accept_%s", data.Values[0]),
+								CustomID: fmt.Sprintf("remove_rule_accept_%s", id),
 							},
 							discordgo.Button{
 								Label:    "No",
 								Style:    discordgo.DangerButton,
 								Disabled: false,
-								CustomID: fmt.Sprintf("remove_rule_decline_%s", data.Values[0]),
+								CustomID: fmt.Sprintf("remove_rule_decline_%s", id),
 							},
 						},
 					},
@@ -314,8 +807,12 @@ var componentHandlers = map[string]func(s *discordgo.Session, i *discordgo.Inter
 
 var componentResponseHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot, d string){
 	"remove_rule_accept": func(s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot, d string) {
-		if c, ok := b.config.NotifierChannels[i.ChannelID]; ok {
-			err := c.RemoveRule(d, b.config.Env)
+		if c, ok := b.ChannelConfig(i.ChannelID); ok {
+			var rule *ChannelConfigRule
+			id, err := strconv.ParseInt(d, 10, 32)
+			if err == nil {
+				rule, err = c.RemoveRuleByID(int32(id), b.config.Env)
+			}
 			if err != nil {
 				Respond(s, i, &discordgo.InteractionResponse{
 					Type: discordgo.InteractionResponseUpdateMessage,
@@ -331,7 +828,7 @@ var componentResponseHandlers = map[string]func(s *discordgo.Session, i *discord
 			Respond(s, i, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseUpdateMessage,
 				Data: &discordgo.InteractionResponseData{
-					Content: fmt.Sprintf("Rule `%s` removed ✅", d),
+					Content: fmt.Sprintf("Rule %s removed ✅", rule),
 					Flags:   discordgo.MessageFlagsEphemeral,
 				},
 			})
@@ -384,51 +881,147 @@ var componentResponseHandlers = map[string]func(s *discordgo.Session, i *discord
 
 var modalHandlers = map[string]func(data *discordgo.ModalSubmitInteractionData, s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot){
 	"ar_submit": func(data *discordgo.ModalSubmitInteractionData, s *discordgo.Session, i *discordgo.InteractionCreate, b *DiscordBot) {
-		model := data.Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
-
-		if c, ok := b.config.NotifierChannels[i.ChannelID]; ok {
-			err := c.AddRule(model, b.config.Env)
-			if err != nil {
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionResponseData{
-						Content: fmt.Sprintf("Unable to create rule: %s", err.Error()),
-						Flags:   discordgo.MessageFlagsEphemeral,
-					},
-				})
+		rule := &ChannelConfigRule{}
+		content := ""
+		for _, row := range data.Components {
+			input := row.(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput)
+			value := strings.TrimSpace(input.Value)
+			switch input.CustomID {
+			case "query":
+				rule.Query = value
+			case "max_price":
+				value = strings.TrimPrefix(value, "$")
+				if value == "" {
+					continue
+				}
 
+				maxPrice, err := strconv.ParseFloat(value, 64)
 				if err != nil {
-					log.Printf("Could not process modal response: %s\n", err.Error())
+					content = fmt.Sprintf("Unable to create rule: %q is not a price", input.Value)
 				}
-
-				return
+				rule.MaxPrice = maxPrice
+			case "brand":
+				rule.Brand = value
+			case "event":
+				// Accept "price drop" as well as price_drop
+				rule.Event = strings.ReplaceAll(strings.ToLower(value), " ", "_")
 			}
+		}
 
-			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-				Type: discordgo.InteractionResponseChannelMessageWithSource,
-				Data: &discordgo.InteractionResponseData{
-					Content: fmt.Sprintf("New rule created for `%s` ✅\nYou will now recieve notifications in this channel when a GPU matching this model is updated", model),
-					Flags:   discordgo.MessageFlagsEphemeral,
-				},
-			})
-			if err != nil {
-				log.Printf("Could not process modal response: %s\n", err.Error())
-			}
-		} else {
-			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-				Type: discordgo.InteractionResponseChannelMessageWithSource,
-				Data: &discordgo.InteractionResponseData{
-					Content: "Error in form submission: channel not in configuration map",
-					Flags:   discordgo.MessageFlagsEphemeral,
-				},
-			})
-			if err != nil {
-				log.Printf("Could not process modal response: %s\n", err.Error())
-			}
+		if content == "" {
+			content = addRule(b, i.ChannelID, rule)
+		}
+
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			log.Printf("Could not process modal response: %s\n", err.Error())
 		}
 	},
 }
 
+// Builds the add-rule form, filled in with the parts of rule that are already known. Brand and event are
+// typed rather than chosen, since forms can't have select menus, and are checked by the rule's Validate.
+func addRuleModal(rule *ChannelConfigRule) *discordgo.InteractionResponse {
+	maxPrice := ""
+	if rule.MaxPrice > 0 {
+		maxPrice = strconv.FormatFloat(rule.MaxPrice, 'f', -1, 64)
+	}
+
+	return &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: "ar_submit",
+			Title:    "New Rule",
+			Flags:    discordgo.MessageFlagsEphemeral,
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:    "query",
+							Label:       "GPU Model to get updates for",
+							Style:       discordgo.TextInputShort,
+							Placeholder: "Model...",
+							Value:       rule.Query,
+							MinLength:   1,
+							MaxLength:   maxRuleQueryLength,
+							Required:    true,
+						},
+					},
+				},
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:    "max_price",
+							Label:       "Only notify at or below this price",
+							Style:       discordgo.TextInputShort,
+							Placeholder: "Any price",
+							Value:       maxPrice,
+							Required:    false,
+						},
+					},
+				},
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:    "brand",
+							Label:       "Only notify for this brand",
+							Style:       discordgo.TextInputShort,
+							Placeholder: "Any brand, or " + strings.Join(ruleBrands, ", "),
+							Value:       rule.Brand,
+							Required:    false,
+						},
+					},
+				},
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:    "event",
+							Label:       "Changes to notify about",
+							Style:       discordgo.TextInputShort,
+							Placeholder: fmt.Sprintf("%s, %s or %s", RuleEventAny, RuleEventPriceDrop, RuleEventRestock),
+							Value:       rule.Event,
+							Required:    false,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// Adds a rule to a channel from the add-rule command or form, returning the message to reply with. The
+// rule is validated before anything is saved.
+func addRule(b *DiscordBot, channelID string, rule *ChannelConfigRule) string {
+	c, ok := b.ChannelConfig(channelID)
+	if !ok {
+		return "This channel has not been configured to recieve notifications, use /subscribe first"
+	}
+
+	err := c.AddRule(rule, b.config.Env)
+	if err != nil {
+		return fmt.Sprintf("Unable to create rule: %s", err.Error())
+	}
+
+	content := fmt.Sprintf("New rule created for %s ✅\nYou will now recieve notifications in this channel when a GPU matching this rule is updated", rule)
+
+	// Show how often the rule would have fired so it's clear whether it's too broad or too narrow
+	now := time.Now()
+	result, err := Backtest(b.config.Env, rule, now.AddDate(0, 0, -backtestDefaultDays), now)
+	if err != nil {
+		log.Printf("Could not backtest rule %s: %s\n", rule.Query, err.Error())
+	} else {
+		content += "\n\n" + result.Summary(backtestSummaryHits)
+	}
+
+	return content
+}
+
 // Helper function for the list command handler to get paginated results
 func GetListPage(p int, b *DiscordBot) (*discordgo.InteractionResponseData, error) {
 	gpus, err := GetAllGPUs(b.config.Env)
@@ -445,7 +1038,7 @@ func GetListPage(p int, b *DiscordBot) (*discordgo.InteractionResponseData, erro
 		stockedGpus = append(stockedGpus, gpu)
 	}
 
-	pageLen := 8
+	pageLen := b.config.Env.Config.Discord.ListPageSize
 	maxPages := (len(stockedGpus) + (pageLen - 1)) / pageLen
 	start := pageLen * p
 	end := min(start+pageLen, len(stockedGpus)-1)
@@ -454,20 +1047,12 @@ func GetListPage(p int, b *DiscordBot) (*discordgo.InteractionResponseData, erro
 	for i := start; i < end; i++ {
 		gpu := stockedGpus[i]
 		imageURL := fmt.Sprintf("https://90a1c75758623581b3f8-5c119c3de181c9857fcb2784776b17ef.ssl.cf2.rackcdn.com/%v_%s_01_front_zoom.jpg", gpu.ID, gpu.SKU)
-		color := 0
-		if gpu.Brand == "NVIDIA" {
-			color = 1433088
-		} else if gpu.Brand == "AMD" {
-			color = 16711680
-		} else if gpu.Brand == "Intel" {
-			color = 5198591
-		}
 		embed := &discordgo.MessageEmbed{
 			URL:         gpu.Link,
 			Thumbnail:   &discordgo.MessageEmbedThumbnail{URL: imageURL},
 			Title:       fmt.Sprintf("%s %s %s %s", gpu.Manufacturer, gpu.Brand, gpu.Line, gpu.ProductModel),
 			Description: fmt.Sprintf("$%v - %v in stock at Microcenter", gpu.Price, gpu.Stock),
-			Color:       color,
+			Color:       brandColor(gpu.Brand),
 		}
 		embeds = append(embeds, embed)
 	}
@@ -518,6 +1103,20 @@ func GetListPage(p int, b *DiscordBot) (*discordgo.InteractionResponseData, erro
 	return response, nil
 }
 
+// Gets the embed color for a GPU brand
+func brandColor(brand string) int {
+	switch brand {
+	case "NVIDIA":
+		return 1433088
+	case "AMD":
+		return 16711680
+	case "Intel":
+		return 5198591
+	}
+
+	return 0
+}
+
 // Sends a response to an Interaction with error handling. If an error occurs, it will try to send a response notifying the user of the error.
 func Respond(s *discordgo.Session, i *discordgo.InteractionCreate, r *discordgo.InteractionResponse) {
 	err := s.InteractionRespond(i.Interaction, r)
@@ -538,6 +1137,55 @@ func Respond(s *discordgo.Session, i *discordgo.InteractionCreate, r *discordgo.
 	}
 }
 
+// Reports whether the bot is currently connected to the Discord gateway
+func (bot *DiscordBot) Connected() bool {
+	return bot.connected.Load()
+}
+
+// Gets the configuration for a channel by its Discord channel ID
+func (bot *DiscordBot) ChannelConfig(channelID string) (*ChannelConfig, bool) {
+	bot.channelsMu.RLock()
+	defer bot.channelsMu.RUnlock()
+
+	c, ok := bot.config.NotifierChannels[channelID]
+	return c, ok
+}
+
+// Adds or replaces a channel configuration in the channel:config map
+func (bot *DiscordBot) SetChannelConfig(c *ChannelConfig) {
+	bot.channelsMu.Lock()
+	defer bot.channelsMu.Unlock()
+
+	bot.config.NotifierChannels[c.ChannelID] = c
+}
+
+// Gets every channel configuration, ordered by channel ID
+func (bot *DiscordBot) ChannelConfigs() []*ChannelConfig {
+	bot.channelsMu.RLock()
+	defer bot.channelsMu.RUnlock()
+
+	configs := make([]*ChannelConfig, 0, len(bot.config.NotifierChannels))
+	for _, c := range bot.config.NotifierChannels {
+		configs = append(configs, c)
+	}
+	slices.SortFunc(configs, func(a, b *ChannelConfig) int {
+		return strings.Compare(a.ChannelID, b.ChannelID)
+	})
+
+	return configs
+}
+
+// Gets a human readable name for a channel from the session state cache, falling back to the channel ID
+func (bot *DiscordBot) ChannelName(channelID string) string {
+	if bot.session.State != nil {
+		if channel, err := bot.session.State.Channel(channelID); err == nil && channel.Name != "" {
+			return "#" + channel.Name
+		}
+	}
+
+	return channelID
+}
+
 // Creates the discord API session and registers the bot's commands
 func (bot *DiscordBot) Open() error {
 	err := bot.session.Open()
@@ -557,6 +1205,11 @@ func (bot *DiscordBot) Open() error {
 		registeredCommands[i] = cmd
 	}
 
+	err = bot.SendPendingNotifications()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
 	log.Println("Discord bot ready")
 
 	return nil
@@ -571,12 +1224,93 @@ func (bot *DiscordBot) Close() error {
 	return bot.session.Close()
 }
 
-// Send a string message to all the channels in the channel:config map
-func (bot *DiscordBot) NotifyChannels(diffs []*GPUDifference) error {
+// Sends notifications for a set of differences in the background. Use Flush to wait for them to finish.
+func (bot *DiscordBot) Dispatch(diffs []*GPUDifference) {
+	bot.notifying.Add(1)
+	go func() {
+		defer bot.notifying.Done()
+
+		err := bot.NotifyChannels(bot.notifyCtx, diffs)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}()
+}
+
+// Waits for background notifications to be sent. If ctx is done first, the remaining sends are cancelled
+// and their messages are saved to be sent the next time the bot starts.
+func (bot *DiscordBot) Flush(ctx context.Context) error {
+	done := make(chan bool)
+	go func() {
+		bot.notifying.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		log.Println("Notifications did not finish sending in time, saving the rest for later")
+		bot.notifyCancel()
+		<-done
+		return fmt.Errorf("error in flushing notifications: %s", ctx.Err().Error())
+	}
+}
+
+// Saves a message that couldn't be sent so it can be retried when the bot next starts
+func (bot *DiscordBot) persistNotification(channelID string, message *discordgo.MessageSend) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Could not save notification for channel %s: %s\n", channelID, err.Error())
+		return
+	}
+
+	result := bot.config.Env.DB.Create(&PendingNotification{
+		ChannelID: channelID,
+		Payload:   string(payload),
+	})
+	if result.Error != nil {
+		log.Printf("Could not save notification for channel %s: %s\n", channelID, result.Error)
+	}
+}
+
+// Sends any notifications that were saved during the last shutdown and removes them once delivered
+func (bot *DiscordBot) SendPendingNotifications() error {
+	var pending []*PendingNotification
+	result := bot.config.Env.DB.Order("id").Find(&pending)
+	if result.Error != nil {
+		return fmt.Errorf("could not load pending notifications: %s", result.Error)
+	}
+
+	for _, p := range pending {
+		var message discordgo.MessageSend
+		err := json.Unmarshal([]byte(p.Payload), &message)
+		if err == nil {
+			_, err = bot.session.ChannelMessageSendComplex(p.ChannelID, &message)
+			ObserveNotification("discord", err)
+		}
+		if err != nil {
+			log.Printf("Could not send pending notification to channel %s: %s\n", p.ChannelID, err.Error())
+			continue
+		}
+
+		bot.config.Env.DB.Unscoped().Delete(p)
+	}
+
+	if len(pending) > 0 {
+		log.Printf("Sent %d pending notifications\n", len(pending))
+	}
+
+	return nil
+}
+
+// Send a string message to all the channels in the channel:config map. If ctx is cancelled, messages
+// that haven't been sent yet are saved as pending notifications instead.
+func (bot *DiscordBot) NotifyChannels(ctx context.Context, diffs []*GPUDifference) error {
 	iterations := 0
-	for _, channel := range bot.config.NotifierChannels {
+	for _, channel := range bot.ChannelConfigs() {
 		var embeds []*discordgo.MessageEmbed
-		for _, rule := range channel.Rules {
+		for _, rule := range channel.CurrentRules() {
 			matches, err := QueryRule(bot.config.Env, rule)
 			if err != nil {
 				return fmt.Errorf("error in sending notifications: %s", err.Error())
@@ -588,29 +1322,14 @@ func (bot *DiscordBot) NotifyChannels(diffs []*GPUDifference) error {
 						log.Println(diff)
 					}
 					iterations++
-					if match.ID != diff.GPUID {
+					if match.ID != diff.GPUID || !rule.Triggers(diff) {
 						continue
 					}
 
-					description := ""
-					difference := false
-					if diff.PriceOld != diff.PriceNew {
-						description = description + fmt.Sprintf("Price: ~~$%v~~ -> %v\n", diff.PriceOld, diff.PriceNew)
-						difference = true
-					}
-					if diff.StockOld != diff.StockNew {
-						description = description + fmt.Sprintf("Stock: ~~%v~~ -> %v\n", diff.StockOld, diff.StockNew)
-						difference = true
-					}
-
-					if !difference {
+					embed, ok := DiffEmbed(match, diff)
+					if !ok {
 						continue
 					}
-
-					embed := &discordgo.MessageEmbed{
-						Title:       fmt.Sprintf("%s %s %s %s", match.Manufacturer, match.Brand, match.Line, match.ProductModel),
-						Description: description,
-					}
 					embeds = append(embeds, embed)
 				}
 			}
@@ -621,16 +1340,70 @@ func (bot *DiscordBot) NotifyChannels(diffs []*GPUDifference) error {
 			continue
 		}
 
-		bot.session.ChannelMessageSendComplex(channel.ChannelID, &discordgo.MessageSend{
-			Content: "A GPU you are tracking has been updated!",
+		message := &discordgo.MessageSend{
+			Content: notificationContent,
 			Embeds:  embeds,
-		})
+		}
+		if ctx.Err() != nil {
+			bot.persistNotification(channel.ChannelID, message)
+			continue
+		}
+
+		_, err := bot.session.ChannelMessageSendComplex(channel.ChannelID, message, discordgo.WithContext(ctx))
+		if err != nil && ctx.Err() != nil {
+			bot.persistNotification(channel.ChannelID, message)
+			continue
+		}
+		ObserveNotification("discord", err)
+		if err != nil {
+			log.Printf("Could not send notification to channel %s: %s\n", channel.ChannelID, err.Error())
+		}
 	}
 	log.Printf("Notifier went through %v iterations\n", iterations)
 
 	return nil
 }
 
+// Builds the notification embed describing how a GPU changed. Returns false if neither its price nor
+// its stock changed.
+func DiffEmbed(gpu *GPU, diff *GPUDifference) (*discordgo.MessageEmbed, bool) {
+	description := ""
+	difference := false
+	if diff.PriceOld != diff.PriceNew {
+		description = description + fmt.Sprintf("Price: ~~$%v~~ -> %v\n", diff.PriceOld, diff.PriceNew)
+		difference = true
+	}
+	if diff.StockOld != diff.StockNew {
+		description = description + fmt.Sprintf("Stock: ~~%v~~ -> %v\n", diff.StockOld, diff.StockNew)
+		difference = true
+	}
+
+	if !difference {
+		return nil, false
+	}
+
+	return &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("%s %s %s %s", gpu.Manufacturer, gpu.Brand, gpu.Line, gpu.ProductModel),
+		Description: description,
+	}, true
+}
+
+// Gets the handler key for a component custom ID so IDs carrying data (such as page numbers) share one
+// metric label
+func interactionMetricName(customID string) string {
+	if _, ok := componentHandlers[customID]; ok {
+		return customID
+	}
+
+	for k := range componentResponseHandlers {
+		if strings.HasPrefix(customID, k) {
+			return k
+		}
+	}
+
+	return "unknown"
+}
+
 // Creates a new discord bot with a given configuration
 func NewDiscordBot(config *DiscordBotConfig) (*DiscordBot, error) {
 	log.Println("Starting Discord bot...")
@@ -638,6 +1411,7 @@ func NewDiscordBot(config *DiscordBotConfig) (*DiscordBot, error) {
 	bot := &DiscordBot{
 		config: config,
 	}
+	bot.notifyCtx, bot.notifyCancel = context.WithCancel(context.Background())
 
 	s, err := discordgo.New(fmt.Sprintf("Bot %s", config.Token))
 	if err != nil {
@@ -646,17 +1420,39 @@ func NewDiscordBot(config *DiscordBotConfig) (*DiscordBot, error) {
 
 	// Set up event handlers
 	s.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
+		bot.connected.Store(true)
 		log.Printf("Successfully logged in as: %v#%v\n", s.State.User.Username, s.State.User.Discriminator)
 	})
+	s.AddHandler(func(s *discordgo.Session, r *discordgo.Resumed) {
+		bot.connected.Store(true)
+	})
+	s.AddHandler(func(s *discordgo.Session, d *discordgo.Disconnect) {
+		bot.connected.Store(false)
+		log.Println("Discord gateway disconnected")
+	})
 	s.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		start := time.Now()
+		name := ""
+		defer func() {
+			discordInteractionDuration.WithLabelValues(i.Type.String(), name).Observe(time.Since(start).Seconds())
+		}()
+
 		switch i.Type {
 		case discordgo.InteractionApplicationCommand:
 			data := i.ApplicationCommandData()
+			name = data.Name
 			if handler, ok := commandHandlers[data.Name]; ok {
 				handler(s, i, bot)
 			}
+		case discordgo.InteractionApplicationCommandAutocomplete:
+			data := i.ApplicationCommandData()
+			name = data.Name
+			if handler, ok := autocompleteHandlers[data.Name]; ok {
+				handler(s, i, bot)
+			}
 		case discordgo.InteractionMessageComponent:
 			data := i.MessageComponentData()
+			name = interactionMetricName(data.CustomID)
 			if handler, ok := componentHandlers[data.CustomID]; ok {
 				// Catch any interactions that don't have any custom data with them
 				handler(s, i, bot)
@@ -673,6 +1469,7 @@ func NewDiscordBot(config *DiscordBotConfig) (*DiscordBot, error) {
 			}
 		case discordgo.InteractionModalSubmit:
 			data := i.ModalSubmitData()
+			name = data.CustomID
 
 			if handler, ok := modalHandlers[data.CustomID]; ok {
 				handler(&data, s, i, bot)
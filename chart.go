@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"time"
+)
+
+// Size of price charts in pixels
+const (
+	chartWidth   = 640
+	chartHeight  = 240
+	chartPadding = 12
+	// Horizontal grid lines drawn across the chart
+	chartGridLines = 4
+)
+
+var (
+	chartBackground = color.RGBA{0x2b, 0x2d, 0x31, 0xff}
+	chartGrid       = color.RGBA{0x3f, 0x41, 0x47, 0xff}
+)
+
+// Colors of the lines in a price chart, matching the square emoji used to label them in messages
+var chartSeries = [...]struct {
+	Color color.RGBA
+	Emoji string
+}{
+	{color.RGBA{0x78, 0xb1, 0x59, 0xff}, "🟩"},
+	{color.RGBA{0x55, 0xac, 0xee, 0xff}, "🟦"},
+	{color.RGBA{0xdd, 0x2e, 0x44, 0xff}, "🟥"},
+	{color.RGBA{0xfd, 0xcb, 0x58, 0xff}, "🟨"},
+	{color.RGBA{0xaa, 0x8e, 0xd6, 0xff}, "🟪"},
+	{color.RGBA{0xf4, 0x90, 0x0c, 0xff}, "🟧"},
+}
+
+// Draws the price history of each summary from since to until as a PNG. Prices only change when a new
+// one is recorded, so each GPU is drawn as a step line. The line for the nth summary uses the nth color of
+// chartSeries.
+func RenderPriceChart(summaries []*PriceSummary, since, until time.Time) ([]byte, error) {
+	if len(summaries) > len(chartSeries) {
+		return nil, fmt.Errorf("can't chart more than %d GPUs at once", len(chartSeries))
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{chartBackground}, image.Point{}, draw.Src)
+
+	plot := image.Rect(chartPadding, chartPadding, chartWidth-chartPadding, chartHeight-chartPadding)
+	for i := 0; i <= chartGridLines; i++ {
+		y := plot.Min.Y + i*(plot.Dy()-1)/chartGridLines
+		draw.Draw(img, image.Rect(plot.Min.X, y, plot.Max.X, y+1), &image.Uniform{chartGrid}, image.Point{}, draw.Src)
+	}
+
+	low, high := 0.0, 0.0
+	for i, summary := range summaries {
+		if i == 0 || summary.Low < low {
+			low = summary.Low
+		}
+		if i == 0 || summary.High > high {
+			high = summary.High
+		}
+	}
+	// Leave some room above and below so flat lines aren't drawn on the border
+	margin := max((high-low)*0.1, 1)
+	low, high = low-margin, high+margin
+
+	x := func(t time.Time) int {
+		span := until.Sub(since)
+		offset := min(max(t.Sub(since), 0), span)
+		return plot.Min.X + int(float64(plot.Dx()-1)*float64(offset)/float64(span))
+	}
+	y := func(price float64) int {
+		return plot.Max.Y - 1 - int(float64(plot.Dy()-1)*(price-low)/(high-low))
+	}
+
+	for i, summary := range summaries {
+		line := &image.Uniform{chartSeries[i].Color}
+		// Lines are 2 pixels thick
+		segment := func(x0, y0, x1, y1 int) {
+			r := image.Rect(min(x0, x1), min(y0, y1), max(x0, x1)+2, max(y0, y1)+2)
+			draw.Draw(img, r.Intersect(plot), line, image.Point{}, draw.Over)
+		}
+
+		points := summary.History
+		for j, point := range points {
+			end := until
+			if j+1 < len(points) {
+				end = points[j+1].Time
+			}
+
+			segment(x(point.Time), y(point.Price), x(end), y(point.Price))
+			if j+1 < len(points) {
+				segment(x(end), y(point.Price), x(end), y(points[j+1].Price))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return nil, fmt.Errorf("could not render price chart: %s", err.Error())
+	}
+
+	return buf.Bytes(), nil
+}
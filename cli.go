@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gopkg.in/yaml.v3"
+)
+
+// Commands that can be run instead of starting the server, keyed by the first command line argument
+var cliCommands = map[string]func(args []string) error{
+	"serve":         RunServe,
+	"scrape":        RunScrape,
+	"export":        RunExport,
+	"export-prices": RunExportPrices,
+	"import":        RunImport,
+	"migrate":       RunMigrate,
+	"compact":       RunCompact,
+	"runs":          RunListScrapeRuns,
+	"reparse":       RunReparse,
+	"backtest":      RunBacktest,
+	"backup":        RunBackup,
+	"restore":       RunRestore,
+	"notify-test":   RunNotifyTest,
+	"create-admin":  RunCreateAdmin,
+	"create-token":  RunCreateToken,
+	"config":        RunConfig,
+}
+
+// Opens just the database, for commands that don't need the scraper or Discord bot
+func InitCLIEnvironment(cfg *Config) (*Env, error) {
+	DB, err := OpenDatabase(cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("error in initialization: %s", err.Error())
+	}
+
+	return &Env{DB: DB, Config: cfg}, nil
+}
+
+// Reads one line from stdin after printing a prompt
+func prompt(message string) (string, error) {
+	fmt.Print(message)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("could not read input: %s", err.Error())
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Creates an admin user for the web server. The password is read from GPUBUD_ADMIN_PASSWORD if it is set,
+// otherwise it is prompted for.
+//
+//	gpubud create-admin -username alice
+func RunCreateAdmin(args []string) error {
+	fs := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	username := fs.String("username", "admin", "name of the admin user to create")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	password, err := GetEnvironmentVariable("GPUBUD_ADMIN_PASSWORD")
+	if err != nil {
+		password, err = prompt(fmt.Sprintf("Password for %s: ", *username))
+		if err != nil {
+			return err
+		}
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	user, err := CreateUser(env, *username, password, true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created admin user %s\n", user.Username)
+	return nil
+}
+
+// Creates an API token for an existing user and prints it. The token is only ever shown once.
+//
+//	gpubud create-token -username alice -name grafana -scopes gpus:read
+func RunCreateToken(args []string) error {
+	fs := flag.NewFlagSet("create-token", flag.ExitOnError)
+	username := fs.String("username", "admin", "user the token belongs to")
+	name := fs.String("name", "", "a label to identify the token")
+	scopes := fs.String("scopes", ScopeGPUsRead, "comma separated list of scopes: "+strings.Join(apiScopes, ", "))
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("a token name is required")
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	var user User
+	result := env.DB.First(&user, "username = ?", *username)
+	if result.Error != nil {
+		return fmt.Errorf("could not find user %s: %s", *username, result.Error)
+	}
+
+	token, err := CreateAPIToken(env, &user, *name, strings.Split(*scopes, ","))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token)
+	return nil
+}
+
+// Works with the config file. The only subcommand is check, which loads the config from every source,
+// validates it and prints the effective values with secrets redacted.
+//
+//	gpubud config check -config gpubud.yaml
+func RunConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("usage: gpubud config check [flags]")
+	}
+
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args[1:])
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return fmt.Errorf("could not print config: %s", err.Error())
+	}
+	fmt.Print(string(out))
+
+	// A config that can't start the server is still printed, so it's clear which values are missing
+	err = cfg.ValidateServe()
+	if err != nil {
+		return fmt.Errorf("config is not complete enough to run the server: %s", err.Error())
+	}
+
+	fmt.Println("config OK")
+	return nil
+}
+
+// Runs a single scrape. With -dry-run the changes the scrape would make are printed and nothing is written
+// to the database or sent to Discord.
+//
+//	gpubud scrape -once -dry-run
+func RunScrape(args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	once := fs.Bool("once", false, "scrape once and exit")
+	dryRun := fs.Bool("dry-run", false, "print the changes the scrape would make without saving them")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	if !*once {
+		return fmt.Errorf("scrape only supports -once, use serve to scrape on a schedule")
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	if cfg.Scraper.MicrocenterURL == "" {
+		return fmt.Errorf("scraper.microcenter_url must be set (or MICROCENTER_URL)")
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if !*dryRun {
+		env.Events = NewEventHub()
+		return Scrape(ctx, env)
+	}
+
+	data, _, err := RunMicrocenterScraper(ctx, cfg.Scraper.MicrocenterURL)
+	if err != nil {
+		return err
+	}
+
+	changed := 0
+	for _, gpu := range data.GPUs {
+		diff, err := Difference(gpu, env)
+		if err != nil {
+			return err
+		}
+		if !diff.IsDiff {
+			continue
+		}
+
+		changed++
+		if diff.PriceOld == 0 && diff.StockOld == 0 {
+			fmt.Printf("new  %d %s: $%.2f, stock %d\n", gpu.ID, gpu.Name, diff.PriceNew, diff.StockNew)
+		} else {
+			fmt.Printf("diff %d %s: $%.2f -> $%.2f, stock %d -> %d\n", gpu.ID, gpu.Name, diff.PriceOld, diff.PriceNew, diff.StockOld, diff.StockNew)
+		}
+	}
+
+	missing, err := MissingGPUs(env, data.GPUs)
+	if err != nil {
+		return fmt.Errorf("could not find missing GPUs: %s", err.Error())
+	}
+	for _, gpu := range missing {
+		if gpu.Stock > 0 {
+			changed++
+			fmt.Printf("gone %d %s: stock %d -> 0\n", gpu.ID, gpu.Name, gpu.Stock)
+		}
+	}
+
+	fmt.Printf("%d GPUs scraped, %d would change\n", len(data.GPUs), changed)
+	return nil
+}
+
+// Applies database migrations. By default every pending migration is applied; -to migrates up or down to
+// a specific version, -status lists migrations and -verify checks every migration against scratch databases.
+//
+//	gpubud migrate -to 3
+func RunMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.Int("to", -1, "schema version to migrate up or down to (default latest)")
+	status := fs.Bool("status", false, "list migrations and whether they have been applied")
+	verify := fs.Bool("verify", false, "check that every migration applies and rolls back cleanly on scratch databases")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	if *verify {
+		err := VerifyMigrations()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("All %d migrations verified\n", LatestSchemaVersion())
+		return nil
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	DB, err := ConnectDatabase(cfg.Database)
+	if err != nil {
+		return fmt.Errorf("could not open database: %s", err.Error())
+	}
+
+	if *status {
+		lines, err := MigrationStatus(DB)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(strings.Join(lines, "\n"))
+		return nil
+	}
+
+	target := *to
+	if target < 0 {
+		target = LatestSchemaVersion()
+	}
+
+	err = MigrateTo(DB, target)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is at schema version %d\n", cfg.Database, target)
+	return nil
+}
+
+// Deletes repeated prices left by versions of gpubud that recorded a price on every scrape, then applies
+// the retention policy. On SQLite the database file is vacuumed afterwards so it actually shrinks.
+//
+//	gpubud compact -dry-run
+func RunCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print how many prices would be deleted without deleting them")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	removed, err := CompactPrices(ctx, env, time.Duration(cfg.Retention.Heartbeat), *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Printf("%d repeated prices would be deleted\n", removed)
+		return nil
+	}
+	fmt.Printf("Deleted %d repeated prices\n", removed)
+
+	err = ApplyPriceRetention(ctx, env)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Database.Driver == DriverSQLite {
+		result := env.DB.WithContext(ctx).Exec("VACUUM")
+		if result.Error != nil {
+			return fmt.Errorf("could not vacuum database: %s", result.Error)
+		}
+	}
+
+	return nil
+}
+
+// Lists the most recent scrape runs
+//
+//	gpubud runs -n 50
+func RunListScrapeRuns(args []string) error {
+	fs := flag.NewFlagSet("runs", flag.ExitOnError)
+	limit := fs.Int("n", 20, "number of runs to list")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	var runs []*ScrapeRun
+	result := env.DB.Omit("payload_html", "payload_json").Order("id desc").Limit(*limit).Find(&runs)
+	if result.Error != nil {
+		return fmt.Errorf("could not load scrape runs: %s", result.Error)
+	}
+
+	archived := make(map[uint]bool)
+	var ids []uint
+	env.DB.Model(&ScrapeRun{}).Where("payload_html IS NOT NULL").Pluck("id", &ids)
+	for _, id := range ids {
+		archived[id] = true
+	}
+
+	for _, run := range runs {
+		duration := "-"
+		if run.FinishedAt != nil {
+			duration = run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond).String()
+		}
+		page := ""
+		if archived[run.ID] {
+			page = "  archived"
+		}
+		fmt.Printf("%6d  %s  %-11s %-9s %8s  %4d items  %4d changed%s  %s\n", run.ID, run.StartedAt.Format(time.RFC3339), run.Retailer, run.Status, duration, run.ItemCount, run.Changed, page, run.Error)
+	}
+
+	return nil
+}
+
+// Parses the archived page of a scrape run with the current scraper and prints how the result differs
+// from what the scraper originally returned
+//
+//	gpubud reparse 1234
+func RunReparse(args []string) error {
+	fs := flag.NewFlagSet("reparse", flag.ExitOnError)
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gpubud reparse [flags] <run id>")
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid run id %q", fs.Arg(0))
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	var run ScrapeRun
+	result := env.DB.First(&run, id)
+	if result.Error != nil {
+		return fmt.Errorf("could not find scrape run %d: %s", id, result.Error)
+	}
+
+	fmt.Printf("Run %d at %s: %s, %d items", run.ID, run.StartedAt.Format(time.RFC3339), run.Status, run.ItemCount)
+	if run.Error != "" {
+		fmt.Printf(", error: %s", run.Error)
+	}
+	fmt.Println()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	data, err := ReparseScrapeRun(ctx, &run)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Current parser found %d items\n", len(data.GPUs))
+
+	// Compare against what the scraper returned at the time, if that could be parsed
+	payload, err := run.Payload()
+	if err != nil {
+		return err
+	}
+	original, err := parseScraperOutput(payload.Output)
+	if err != nil {
+		fmt.Println("The archived scraper output could not be parsed, so there is nothing to compare against")
+		return nil
+	}
+
+	before := make(map[int32]*GPU)
+	for _, gpu := range original.GPUs {
+		before[gpu.ID] = gpu
+	}
+
+	differences := 0
+	for _, gpu := range data.GPUs {
+		old, ok := before[gpu.ID]
+		delete(before, gpu.ID)
+		if !ok {
+			differences++
+			fmt.Printf("+ %d %s\n", gpu.ID, gpu.Name)
+			continue
+		}
+
+		if *old != *gpu {
+			differences++
+			fmt.Printf("~ %d %s\n    was: %s | %s | %s | %s | $%.2f | stock %d\n    now: %s | %s | %s | %s | $%.2f | stock %d\n",
+				gpu.ID, gpu.Name,
+				old.Manufacturer, old.Brand, old.Line, old.ProductModel, old.Price, old.Stock,
+				gpu.Manufacturer, gpu.Brand, gpu.Line, gpu.ProductModel, gpu.Price, gpu.Stock)
+		}
+	}
+	for _, gpu := range original.GPUs {
+		if _, ok := before[gpu.ID]; ok {
+			differences++
+			fmt.Printf("- %d %s\n", gpu.ID, gpu.Name)
+		}
+	}
+
+	fmt.Printf("%d differences from the archived output\n", differences)
+	return nil
+}
+
+// Prints every notification a rule would have sent over the last few days
+//
+//	gpubud backtest -days 14 -max-price 600 -event price_drop "4070 Ti"
+func RunBacktest(args []string) error {
+	fs := flag.NewFlagSet("backtest", flag.ExitOnError)
+	days := fs.Int("days", backtestDefaultDays, "how many days back to look")
+	maxPrice := fs.Float64("max-price", 0, "only count changes to this price or lower")
+	brand := fs.String("brand", "", "only match GPUs of this brand")
+	event := fs.String("event", RuleEventAny, "changes to count: any, price_drop or restock")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gpubud backtest [flags] <rule query>")
+	}
+	if *days < 1 {
+		return fmt.Errorf("-days must be at least 1")
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rule := &ChannelConfigRule{Query: fs.Arg(0), MaxPrice: *maxPrice, Brand: *brand, Event: *event}
+	result, err := Backtest(env, rule, now.AddDate(0, 0, -*days), now)
+	if err != nil {
+		return err
+	}
+
+	for _, hit := range result.Hits {
+		fmt.Printf("%s  %6d  %s\n", hit.Time.Local().Format("2006-01-02 15:04"), hit.GPU.ID, hit)
+	}
+	fmt.Printf("%s matches %d GPUs and would have sent %d notifications in the last %d days\n", result.Rule, result.Matched, len(result.Hits), *days)
+
+	return nil
+}
+
+// Backs up the SQLite database. Without -o the backup goes to backup.dir and old backups are rotated
+// like scheduled ones.
+//
+//	gpubud backup -o before-upgrade.db
+func RunBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := fs.String("o", "", "file to write the backup to (default a timestamped file in backup.dir)")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *output == "" {
+		return ScheduledBackup(ctx, env)
+	}
+
+	compress := strings.HasSuffix(*output, ".gz")
+	path, err := BackupDatabase(ctx, env, strings.TrimSuffix(*output, ".gz"), compress)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backed up database to %s\n", path)
+	return nil
+}
+
+// Replaces the SQLite database with a backup, which may be gzip compressed. Stop gpubud first.
+//
+//	gpubud restore backups/gpubud-20250101-000000.db.gz
+func RunRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gpubud restore [flags] <backup file>")
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	if cfg.Database.Driver != DriverSQLite {
+		return fmt.Errorf("restore is only supported for sqlite databases, use pg_restore for postgres")
+	}
+
+	previous, err := RestoreDatabase(fs.Arg(0), cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s from %s\n", cfg.Database.Path, fs.Arg(0))
+	if previous != "" {
+		fmt.Printf("The previous database was kept as %s\n", previous)
+	}
+	return nil
+}
+
+// Sends a sample GPU update notification to a Discord channel to check the bot can post there
+//
+//	gpubud notify-test 123456789012345678
+func RunNotifyTest(args []string) error {
+	fs := flag.NewFlagSet("notify-test", flag.ExitOnError)
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gpubud notify-test [flags] <channel id>")
+	}
+	channelID := fs.Arg(0)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	if cfg.Discord.Token == "" {
+		return fmt.Errorf("discord.token must be set (or DISCORD_BOT_TOKEN)")
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Use a real GPU when there is one so the sample looks like the notifications the channel will get
+	gpu := &GPU{ID: 0, Manufacturer: "ASUS", Brand: "NVIDIA", Line: "GeForce RTX 4070", ProductModel: "Dual", Price: 549.99, Stock: 3}
+	gpus, err := GetAllGPUs(env)
+	if err == nil && len(gpus) > 0 {
+		gpu = gpus[0]
+	}
+
+	diff := &GPUDifference{
+		GPUID:    gpu.ID,
+		GPU:      gpu,
+		PriceOld: gpu.Price + 50,
+		PriceNew: gpu.Price,
+		StockOld: 0,
+		StockNew: max(gpu.Stock, 1),
+		IsDiff:   true,
+	}
+	embed, _ := DiffEmbed(gpu, diff)
+
+	session, err := discordgo.New(fmt.Sprintf("Bot %s", cfg.Discord.Token))
+	if err != nil {
+		return fmt.Errorf("could not create discord session: %s", err.Error())
+	}
+
+	_, err = session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: notificationContent + " (this is a test notification)",
+		Embeds:  []*discordgo.MessageEmbed{embed},
+	})
+	if err != nil {
+		return fmt.Errorf("could not send test notification to channel %s: %s", channelID, err.Error())
+	}
+
+	fmt.Printf("Sent test notification to channel %s\n", channelID)
+	return nil
+}
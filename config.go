@@ -0,0 +1,498 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The config file read when no -config flag or GPUBUD_CONFIG variable is given. It is optional.
+const defaultConfigPath = "gpubud.yaml"
+
+// Shown in place of secrets when printing the config
+const redacted = "[REDACTED]"
+
+// A time.Duration that is written in config files as a Go duration string, such as "5m". Whole days
+// can also be written with a d suffix, such as "30d".
+type Duration time.Duration
+
+// Parses a Go duration string, or a whole number of days such as "30d"
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := parseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", value.Line, value.Value)
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Settings for gpubud. Values are applied in this order, each overriding the last: built in defaults,
+// the config file, environment variables and then command line flags.
+type Config struct {
+	Database  DatabaseConfig  `yaml:"database"`
+	HTTP      HTTPConfig      `yaml:"http"`
+	Scraper   ScraperConfig   `yaml:"scraper"`
+	Discord   DiscordConfig   `yaml:"discord"`
+	Retention RetentionConfig `yaml:"retention"`
+	Backup    BackupConfig    `yaml:"backup"`
+	// Schedules for update jobs by job name, overriding their default schedules
+	Jobs map[string]JobConfig `yaml:"jobs"`
+}
+
+// Database drivers that can be selected with database.driver
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+type DatabaseConfig struct {
+	// Which database to use, sqlite or postgres
+	Driver string `yaml:"driver"`
+	// Path to the SQLite database file
+	Path string `yaml:"path"`
+	// Connection string for PostgreSQL, either a URL or key=value pairs
+	DSN string `yaml:"dsn"`
+}
+
+// Describes the database for messages without revealing credentials
+func (d DatabaseConfig) String() string {
+	if d.Driver == DriverPostgres {
+		return "postgres database"
+	}
+
+	return d.Path
+}
+
+type HTTPConfig struct {
+	// Address the web server listens on
+	Addr string `yaml:"addr"`
+	// Reload templates and static assets from disk on every request
+	Dev bool `yaml:"dev"`
+}
+
+type ScraperConfig struct {
+	// Microcenter search page listing the GPUs to track
+	MicrocenterURL string `yaml:"microcenter_url"`
+	// How often to scrape
+	Interval Duration `yaml:"interval"`
+	// Up to this much random delay is added to each scrape
+	Jitter Duration `yaml:"jitter"`
+}
+
+type DiscordConfig struct {
+	// The bot's Discord API token
+	Token string `yaml:"token"`
+	// Number of GPUs shown per page by the list command
+	ListPageSize int `yaml:"list_page_size"`
+	// Discord user IDs allowed to manage update jobs with /jobs
+	Operators []string `yaml:"operators"`
+}
+
+// Reports whether the Discord user with the given ID may manage update jobs
+func (c DiscordConfig) IsOperator(userID string) bool {
+	return userID != "" && slices.Contains(c.Operators, userID)
+}
+
+type RetentionConfig struct {
+	// A price is recorded at least this often even if it hasn't changed
+	Heartbeat Duration `yaml:"heartbeat"`
+	// How long every recorded price is kept before being rolled up into hourly aggregates
+	Raw Duration `yaml:"raw"`
+	// How long hourly aggregates are kept before being rolled up into daily aggregates
+	Hourly Duration `yaml:"hourly"`
+	// How long daily aggregates are kept. Zero keeps them forever.
+	Daily Duration `yaml:"daily"`
+	// How long the raw pages and scraper output of each scrape run are kept. Zero turns archiving off.
+	Archive Duration `yaml:"archive"`
+}
+
+type BackupConfig struct {
+	// Directory scheduled backups are written to
+	Dir string `yaml:"dir"`
+	// How often to back up the database. Zero turns scheduled backups off.
+	Interval Duration `yaml:"interval"`
+	// Number of backups to keep in Dir. Older ones are deleted after each backup.
+	Keep int `yaml:"keep"`
+	// Compress backups with gzip
+	Gzip bool `yaml:"gzip"`
+}
+
+// Update jobs whose schedule can be set under jobs. The report job runs after every scrape, so it has no
+// schedule of its own.
+var schedulableJobs = []string{"scrape", "retention", "backup"}
+
+type JobConfig struct {
+	// How often the job runs, either an interval such as "30m" or a cron expression such as "0 4 * * *"
+	Schedule string `yaml:"schedule"`
+	// IANA time zone cron expressions are evaluated in, such as "America/Chicago". Defaults to the
+	// local time zone.
+	Timezone string `yaml:"timezone"`
+}
+
+// Parses the job's schedule. An interval is tried first and anything else is read as a cron expression.
+func (j JobConfig) ParseSchedule() (Schedule, error) {
+	loc, err := time.LoadLocation(j.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q", j.Timezone)
+	}
+	// LoadLocation reads an empty name as UTC, but cron expressions default to local time
+	if j.Timezone == "" {
+		loc = time.Local
+	}
+
+	if d, err := parseDuration(j.Schedule); err == nil {
+		return Every(d), nil
+	}
+
+	return ParseCron(j.Schedule, loc)
+}
+
+// Gets the schedule configured for a job, or fallback if there isn't one
+func (c *Config) JobSchedule(name string, fallback Schedule) Schedule {
+	job, ok := c.Jobs[name]
+	if !ok || job.Schedule == "" {
+		return fallback
+	}
+
+	// Validate has already checked the schedule parses
+	schedule, err := job.ParseSchedule()
+	if err != nil {
+		return fallback
+	}
+
+	return schedule
+}
+
+// Returns the config used when nothing else is set
+func DefaultConfig() *Config {
+	return &Config{
+		Database: DatabaseConfig{Driver: DriverSQLite, Path: "gpubud.db"},
+		HTTP:     HTTPConfig{Addr: ":8000"},
+		Scraper: ScraperConfig{
+			Interval: Duration(5 * time.Minute),
+			Jitter:   Duration(30 * time.Second),
+		},
+		Discord: DiscordConfig{ListPageSize: 8},
+		Retention: RetentionConfig{
+			Heartbeat: Duration(time.Hour),
+			Raw:       Duration(7 * 24 * time.Hour),
+			Hourly:    Duration(90 * 24 * time.Hour),
+			Archive:   Duration(14 * 24 * time.Hour),
+		},
+		Backup: BackupConfig{
+			Dir:      "backups",
+			Interval: Duration(24 * time.Hour),
+			Keep:     7,
+			Gzip:     true,
+		},
+	}
+}
+
+// Checks that every setting has a usable value. Settings only needed to run the server, such as the
+// Discord token, are checked by ValidateServe.
+func (c *Config) Validate() error {
+	var errs []error
+
+	switch c.Database.Driver {
+	case DriverSQLite:
+		if c.Database.Path == "" {
+			errs = append(errs, fmt.Errorf("database.path must be set when database.driver is sqlite"))
+		}
+	case DriverPostgres:
+		if c.Database.DSN == "" {
+			errs = append(errs, fmt.Errorf("database.dsn must be set when database.driver is postgres"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("database.driver must be %s or %s", DriverSQLite, DriverPostgres))
+	}
+	if c.HTTP.Addr == "" {
+		errs = append(errs, fmt.Errorf("http.addr must be set"))
+	}
+	if c.Scraper.MicrocenterURL != "" {
+		u, err := url.Parse(c.Scraper.MicrocenterURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("scraper.microcenter_url must be an http or https URL"))
+		}
+	}
+	if time.Duration(c.Scraper.Interval) < time.Minute {
+		errs = append(errs, fmt.Errorf("scraper.interval must be at least 1m"))
+	}
+	if c.Scraper.Jitter < 0 || c.Scraper.Jitter >= c.Scraper.Interval {
+		errs = append(errs, fmt.Errorf("scraper.jitter must be between 0 and scraper.interval"))
+	}
+	// Discord allows at most 10 embeds per message
+	if c.Discord.ListPageSize < 1 || c.Discord.ListPageSize > 10 {
+		errs = append(errs, fmt.Errorf("discord.list_page_size must be between 1 and 10"))
+	}
+	for _, id := range c.Discord.Operators {
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			errs = append(errs, fmt.Errorf("discord.operators must be Discord user IDs, got %q", id))
+		}
+	}
+
+	if time.Duration(c.Retention.Heartbeat) < time.Minute {
+		errs = append(errs, fmt.Errorf("retention.heartbeat must be at least 1m"))
+	}
+	if time.Duration(c.Retention.Raw) < time.Hour {
+		errs = append(errs, fmt.Errorf("retention.raw must be at least 1h"))
+	}
+	if time.Duration(c.Retention.Hourly) < time.Duration(c.Retention.Raw)+24*time.Hour {
+		errs = append(errs, fmt.Errorf("retention.hourly must be at least a day longer than retention.raw"))
+	}
+	if c.Retention.Daily != 0 && c.Retention.Daily <= c.Retention.Hourly {
+		errs = append(errs, fmt.Errorf("retention.daily must be 0 or longer than retention.hourly"))
+	}
+	if c.Retention.Archive < 0 {
+		errs = append(errs, fmt.Errorf("retention.archive must not be negative"))
+	}
+	if c.Backup.Interval != 0 && time.Duration(c.Backup.Interval) < time.Hour {
+		errs = append(errs, fmt.Errorf("backup.interval must be 0 or at least 1h"))
+	}
+	if c.Backup.Dir == "" {
+		errs = append(errs, fmt.Errorf("backup.dir must be set"))
+	}
+	if c.Backup.Keep < 1 {
+		errs = append(errs, fmt.Errorf("backup.keep must be at least 1"))
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Jobs)) {
+		job := c.Jobs[name]
+		if !slices.Contains(schedulableJobs, name) {
+			errs = append(errs, fmt.Errorf("jobs.%s is not a job with a schedule, expected one of %s", name, strings.Join(schedulableJobs, ", ")))
+			continue
+		}
+		if job.Schedule == "" {
+			errs = append(errs, fmt.Errorf("jobs.%s.schedule must be set", name))
+			continue
+		}
+
+		schedule, err := job.ParseSchedule()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("jobs.%s.schedule: %s", name, err.Error()))
+			continue
+		}
+		shortest, _ := scheduleGaps(schedule, time.Now(), 16)
+		if shortest == 0 {
+			errs = append(errs, fmt.Errorf("jobs.%s.schedule never runs", name))
+		} else if shortest < minJobInterval {
+			errs = append(errs, fmt.Errorf("jobs.%s.schedule must not run more than once a minute", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Checks that the settings needed to run the scraper and Discord bot are present
+func (c *Config) ValidateServe() error {
+	var errs []error
+
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Scraper.MicrocenterURL == "" {
+		errs = append(errs, fmt.Errorf("scraper.microcenter_url must be set (or MICROCENTER_URL)"))
+	}
+	if c.Discord.Token == "" {
+		errs = append(errs, fmt.Errorf("discord.token must be set (or DISCORD_BOT_TOKEN)"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Returns a copy of the config with secrets replaced so it can be shown to the user
+func (c *Config) Redacted() *Config {
+	copied := *c
+	if copied.Discord.Token != "" {
+		copied.Discord.Token = redacted
+	}
+	copied.Database.DSN = redactDSN(copied.Database.DSN)
+
+	return &copied
+}
+
+// Matches the password in a key=value connection string
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('[^']*'|\S+)`)
+
+// Hides the password in a PostgreSQL connection string
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
+
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// Reads a YAML config file over the current values. Unknown keys are rejected so typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open config file: %s", err.Error())
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("could not parse config file %s: %s", path, err.Error())
+	}
+
+	return nil
+}
+
+// Applies overrides from environment variables
+func (c *Config) loadEnv() error {
+	if v, err := GetEnvironmentVariable("GPUBUD_DB_DRIVER"); err == nil {
+		c.Database.Driver = v
+	}
+	if v, err := GetEnvironmentVariable("GPUBUD_DB_PATH"); err == nil {
+		c.Database.Path = v
+	}
+	if v, err := GetEnvironmentVariable("GPUBUD_DB_DSN"); err == nil {
+		c.Database.DSN = v
+	}
+	if v, err := GetEnvironmentVariable("GPUBUD_HTTP_ADDR"); err == nil {
+		c.HTTP.Addr = v
+	}
+	if v, err := GetEnvironmentVariable("GPUBUD_DEV"); err == nil {
+		dev, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid GPUBUD_DEV: %s", v)
+		}
+		c.HTTP.Dev = dev
+	}
+	if v, err := GetEnvironmentVariable("MICROCENTER_URL"); err == nil {
+		c.Scraper.MicrocenterURL = v
+	}
+	if v, err := GetEnvironmentVariable("GPUBUD_SCRAPE_INTERVAL"); err == nil {
+		d, err := parseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid GPUBUD_SCRAPE_INTERVAL: %s", v)
+		}
+		c.Scraper.Interval = Duration(d)
+	}
+	if v, err := GetEnvironmentVariable("DISCORD_BOT_TOKEN"); err == nil {
+		c.Discord.Token = v
+	}
+	if v, err := GetEnvironmentVariable("GPUBUD_LIST_PAGE_SIZE"); err == nil {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid GPUBUD_LIST_PAGE_SIZE: %s", v)
+		}
+		c.Discord.ListPageSize = n
+	}
+	if v, err := GetEnvironmentVariable("GPUBUD_DISCORD_OPERATORS"); err == nil {
+		c.Discord.Operators = nil
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				c.Discord.Operators = append(c.Discord.Operators, id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Command line flags that override config values. Register them on a command's FlagSet with
+// RegisterConfigFlags, parse the FlagSet and then call Load.
+type ConfigFlags struct {
+	fs             *flag.FlagSet
+	configPath     string
+	dbDriver       string
+	dbPath         string
+	httpAddr       string
+	dev            bool
+	scrapeInterval time.Duration
+	listPageSize   int
+}
+
+// Adds the config flags to a FlagSet
+func RegisterConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	f := &ConfigFlags{fs: fs}
+	fs.StringVar(&f.configPath, "config", "", "path to the YAML config file (default gpubud.yaml if it exists, or GPUBUD_CONFIG)")
+	fs.StringVar(&f.dbDriver, "db-driver", "", "database driver, sqlite or postgres")
+	fs.StringVar(&f.dbPath, "db", "", "path to the SQLite database")
+	fs.StringVar(&f.httpAddr, "http-addr", "", "address for the web server to listen on")
+	fs.BoolVar(&f.dev, "dev", false, "reload templates and static assets from disk on every request")
+	fs.DurationVar(&f.scrapeInterval, "scrape-interval", 0, "how often to scrape")
+	fs.IntVar(&f.listPageSize, "page-size", 0, "number of GPUs per page in the Discord list command")
+	return f
+}
+
+// Builds the effective config from defaults, the config file, environment variables and the parsed flags
+func (f *ConfigFlags) Load() (*Config, error) {
+	cfg := DefaultConfig()
+
+	path := f.configPath
+	if path == "" {
+		path, _ = GetEnvironmentVariable("GPUBUD_CONFIG")
+	}
+	if path != "" {
+		err := cfg.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(defaultConfigPath); err == nil {
+		err := cfg.loadFile(defaultConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := cfg.loadEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only flags that were given on the command line override earlier values
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "db-driver":
+			cfg.Database.Driver = f.dbDriver
+		case "db":
+			cfg.Database.Path = f.dbPath
+		case "http-addr":
+			cfg.HTTP.Addr = f.httpAddr
+		case "dev":
+			cfg.HTTP.Dev = f.dev
+		case "scrape-interval":
+			cfg.Scraper.Interval = Duration(f.scrapeInterval)
+		case "page-size":
+			cfg.Discord.ListPageSize = f.listPageSize
+		}
+	})
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err.Error())
+	}
+
+	return cfg, nil
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
@@ -37,12 +38,65 @@ type Price struct {
 	Time  time.Time
 }
 
+// Resolutions of price aggregates
+const (
+	ResolutionHour = "hour"
+	ResolutionDay  = "day"
+)
+
+// A summary of a GPU's prices over an hour or a UTC day, kept once the prices it summarizes have been
+// deleted by the retention job. Aggregates are deleted outright rather than soft deleted, since keeping
+// deleted rows around would defeat the point of rolling them up.
+type PriceAggregate struct {
+	ID          uint      `gorm:"primaryKey"`
+	GPUID       int32     `gorm:"column:gpu_id;uniqueIndex:idx_price_aggregates_bucket"`
+	Resolution  string    `gorm:"uniqueIndex:idx_price_aggregates_bucket"`
+	BucketStart time.Time `gorm:"uniqueIndex:idx_price_aggregates_bucket"`
+	Min         float64
+	Max         float64
+	// The last price and stock recorded in the bucket
+	Close      float64
+	CloseStock int32
+	// Number of recorded prices summarized
+	Samples int
+}
+
+// Outcomes of a scrape run
+const (
+	ScrapeRunning   = "running"
+	ScrapeSucceeded = "succeeded"
+	ScrapeFailed    = "failed"
+)
+
+// A record of one scrape and what came of it
+type ScrapeRun struct {
+	gorm.Model
+	Retailer   string
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Status     string
+	// Number of GPUs the scraper returned
+	ItemCount int
+	// Number of GPUs whose price or stock changed, including new ones
+	Changed int
+	Error   string
+	// The page that was scraped
+	Source string
+	// The fetched page and the scraper's output, gzip compressed. Cleared once older than
+	// retention.archive.
+	PayloadHTML []byte
+	PayloadJSON []byte
+}
+
 type ChannelConfig struct {
 	gorm.Model
 	ID         int32                `gorm:"primaryKey"`
 	ChannelID  string               `gorm:"unique;not null"`
 	Rules      []*ChannelConfigRule `gorm:"foreignKey:ChannelConfigRefer"`
 	Subscribed bool                 `gorm:"default:false"`
+	// Guards Rules and Subscribed, which Discord interactions and the admin web UI change while
+	// notifications are being sent
+	mu sync.RWMutex
 }
 
 type ChannelConfigRule struct {
@@ -50,6 +104,34 @@ type ChannelConfigRule struct {
 	ID                 int32 `gorm:"primaryKey"`
 	ChannelConfigRefer uint
 	Query              string
+	// Only notify when the new price is at or below this. 0 means any price.
+	MaxPrice float64
+	// Only match GPUs of this brand. Empty means any brand.
+	Brand string
+	// Which changes to notify about, one of the RuleEvent constants. Empty means RuleEventAny.
+	Event string
+}
+
+// Changes a rule can notify about
+const (
+	RuleEventAny       = "any"
+	RuleEventPriceDrop = "price_drop"
+	RuleEventRestock   = "restock"
+)
+
+// The brands a rule can be limited to
+var ruleBrands = []string{"NVIDIA", "AMD", "Intel"}
+
+// Longest rule query accepted
+const maxRuleQueryLength = 100
+
+// A notification that could not be sent before shutdown. Pending notifications are sent the next time
+// the Discord bot starts.
+type PendingNotification struct {
+	gorm.Model
+	ChannelID string `gorm:"not null"`
+	// The discordgo.MessageSend to deliver, encoded as JSON
+	Payload string `gorm:"not null"`
 }
 
 // ScrapeData is a struct that holds the data scraped from the Microcenter website
@@ -69,20 +151,46 @@ func (c *ChannelConfig) commit(env *Env) error {
 	return nil
 }
 
-func (c *ChannelConfig) AddRule(q string, env *Env) error {
-	// TODO: This is raw user input that gets put into database queries. Sanitization would be preferable
-	cleansedInput := strings.TrimSpace(q)
+// Validates a rule and adds it to the config. A channel has at most one rule per query.
+func (c *ChannelConfig) AddRule(rule *ChannelConfigRule, env *Env) error {
+	rule.Query = strings.TrimSpace(rule.Query)
+	err := rule.Validate()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	for _, v := range c.Rules {
-		if v.Query == cleansedInput {
+		if v.Query == rule.Query {
 			return fmt.Errorf("rule already exists in config")
 		}
 	}
-	c.Rules = append(c.Rules, &ChannelConfigRule{Query: cleansedInput})
+	c.Rules = append(c.Rules, rule)
 	return c.commit(env)
 }
 
+// Finds the channel's rule for a query
+func (c *ChannelConfig) Rule(q string) (*ChannelConfigRule, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cleansedInput := strings.TrimSpace(q)
+	for _, rule := range c.Rules {
+		if rule.Query == cleansedInput {
+			return rule, true
+		}
+	}
+
+	return nil, false
+}
+
 func (c *ChannelConfig) RemoveRule(q string, env *Env) error {
 	// TODO: Same as Addrule(). This user input should be sanitized more.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	cleansedInput := strings.TrimSpace(q)
 	for i, rule := range c.Rules {
 		if rule.Query == cleansedInput {
@@ -95,7 +203,42 @@ func (c *ChannelConfig) RemoveRule(q string, env *Env) error {
 	return fmt.Errorf("could not find rule in config")
 }
 
+// Removes the channel's rule with the given ID, returning the removed rule
+func (c *ChannelConfig) RemoveRuleByID(id int32, env *Env) (*ChannelConfigRule, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, rule := range c.Rules {
+		if rule.ID == id {
+			env.DB.Where("channel_config_refer = ? AND id = ?", c.ID, rule.ID).Delete(&ChannelConfigRule{})
+			c.Rules = slices.Delete(c.Rules, i, i+1)
+			return rule, c.commit(env)
+		}
+	}
+
+	return nil, fmt.Errorf("could not find rule in config")
+}
+
+// Gets a copy of the channel's rules that is safe to use while rules are being added or removed
+func (c *ChannelConfig) CurrentRules() []*ChannelConfigRule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return slices.Clone(c.Rules)
+}
+
+// Reports whether the channel is subscribed for notifications
+func (c *ChannelConfig) IsSubscribed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.Subscribed
+}
+
 func (c *ChannelConfig) Subscribe(env *Env) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.Subscribed {
 		return fmt.Errorf("already subscribed for notifications")
 	}
@@ -105,6 +248,9 @@ func (c *ChannelConfig) Subscribe(env *Env) error {
 }
 
 func (c *ChannelConfig) Unsubscribe(env *Env) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if !c.Subscribed {
 		return fmt.Errorf("not subscribed for notifications")
 	}
@@ -137,10 +283,119 @@ func LoadChannelConfigs(env *Env) ([]*ChannelConfig, error) {
 	return configs, nil
 }
 
+// Checks a rule before it is saved, normalizing its brand and event
+func (rule *ChannelConfigRule) Validate() error {
+	if rule.Query == "" {
+		return fmt.Errorf("a query is required")
+	}
+	if len(rule.Query) > maxRuleQueryLength {
+		return fmt.Errorf("query can't be longer than %d characters", maxRuleQueryLength)
+	}
+	if rule.MaxPrice < 0 {
+		return fmt.Errorf("max price can't be negative")
+	}
+
+	if rule.Brand != "" {
+		i := slices.IndexFunc(ruleBrands, func(brand string) bool {
+			return strings.EqualFold(brand, rule.Brand)
+		})
+		if i < 0 {
+			return fmt.Errorf("unknown brand %q, use one of %s", rule.Brand, strings.Join(ruleBrands, ", "))
+		}
+		rule.Brand = ruleBrands[i]
+	}
+
+	switch rule.Event {
+	case "":
+		rule.Event = RuleEventAny
+	case RuleEventAny, RuleEventPriceDrop, RuleEventRestock:
+	default:
+		return fmt.Errorf("unknown event %q, use %s, %s or %s", rule.Event, RuleEventAny, RuleEventPriceDrop, RuleEventRestock)
+	}
+
+	return nil
+}
+
+// Reports whether a change to a GPU the rule matches should be notified about
+func (rule *ChannelConfigRule) Triggers(diff *GPUDifference) bool {
+	if rule.MaxPrice > 0 && diff.PriceNew > rule.MaxPrice {
+		return false
+	}
+
+	switch rule.Event {
+	case RuleEventPriceDrop:
+		// A GPU's first appearance has no old price, so it isn't a drop
+		return diff.PriceOld > 0 && diff.PriceNew < diff.PriceOld
+	case RuleEventRestock:
+		return diff.StockOld <= 0 && diff.StockNew > 0
+	default:
+		return diff.PriceNew != diff.PriceOld || diff.StockNew != diff.StockOld
+	}
+}
+
+// Describes the rule's filters, such as "NVIDIA, under $500, price drops". Empty if it has none.
+func (rule *ChannelConfigRule) Filters() string {
+	var filters []string
+	if rule.Brand != "" {
+		filters = append(filters, rule.Brand)
+	}
+	if rule.MaxPrice > 0 {
+		filters = append(filters, fmt.Sprintf("up to $%.2f", rule.MaxPrice))
+	}
+	switch rule.Event {
+	case RuleEventPriceDrop:
+		filters = append(filters, "price drops")
+	case RuleEventRestock:
+		filters = append(filters, "restocks")
+	}
+
+	return strings.Join(filters, ", ")
+}
+
+// Describes the rule, such as "`4070` (NVIDIA, up to $500.00)"
+func (rule *ChannelConfigRule) String() string {
+	filters := rule.Filters()
+	if filters == "" {
+		return fmt.Sprintf("`%s`", rule.Query)
+	}
+
+	return fmt.Sprintf("`%s` (%s)", rule.Query, filters)
+}
+
+// The GPU columns a rule's query is matched against, with %s where a table name prefix goes. The ID is cast
+// because Postgres has no LIKE for integers, and LOWER is used because LIKE is case sensitive in Postgres but
+// not in SQLite.
+var ruleQueryColumns = []string{"CAST(%sid AS TEXT)", "LOWER(%ssku)", "LOWER(%sbrand)", "LOWER(%sline)", "LOWER(%smanufacturer)", "LOWER(%sproduct_model)"}
+
+// Builds the SQL condition for GPUs whose ID, SKU, brand, line, manufacturer or model contain pattern,
+// ignoring case. pattern is a SQL expression giving a lowercase LIKE pattern, such as a ? placeholder, and
+// is repeated once per column. prefix qualifies the columns, such as "gpus.".
+func ruleQueryCondition(prefix, pattern string) string {
+	var conditions []string
+	for _, column := range ruleQueryColumns {
+		conditions = append(conditions, fmt.Sprintf(column, prefix)+" LIKE "+pattern+` ESCAPE '\'`)
+	}
+
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+// Finds the GPUs whose ID, SKU, brand, line, manufacturer or model contain the rule's query, ignoring case.
+// If the rule has a brand, only GPUs of that brand are returned.
 func QueryRule(env *Env, rule *ChannelConfigRule) ([]*GPU, error) {
 	var matches []*GPU
-	query := "id LIKE ? OR sku LIKE ? OR brand LIKE ? OR LINE LIKE ? OR manufacturer LIKE ? OR product_model LIKE ?"
-	result := env.DB.Where(query, fmt.Sprintf("%%%s%%", rule.Query), fmt.Sprintf("%%%s%%", rule.Query), fmt.Sprintf("%%%s%%", rule.Query), fmt.Sprintf("%%%s%%", rule.Query), fmt.Sprintf("%%%s%%", rule.Query), fmt.Sprintf("%%%s%%", rule.Query)).Find(&matches)
+	pattern := "%" + escapeLike(strings.ToLower(rule.Query)) + "%"
+
+	var args []any
+	for range ruleQueryColumns {
+		args = append(args, pattern)
+	}
+
+	query := env.DB.Where(ruleQueryCondition("", "?"), args...)
+	if rule.Brand != "" {
+		query = query.Where("LOWER(brand) = ?", strings.ToLower(rule.Brand))
+	}
+
+	result := query.Find(&matches)
 	if result.Error != nil {
 		return nil, fmt.Errorf("could not query rule: %s", result.Error)
 	}
@@ -148,21 +403,51 @@ func QueryRule(env *Env, rule *ChannelConfigRule) ([]*GPU, error) {
 	return matches, nil
 }
 
-// Inserts or updates a GPU in the database and create a new price for the current time
-func InsertGPU(env *Env, gpu *GPU) {
-	env.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(gpu)
-	CreatePrice(env, gpu)
+// Escapes the LIKE wildcards in s so they match literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Inserts or updates a GPU in the database and records its price
+func InsertGPU(env *Env, gpu *GPU) error {
+	result := env.DB.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "id"}}, UpdateAll: true}).Create(gpu)
+	if result.Error != nil {
+		return fmt.Errorf("could not save GPU %d: %s", gpu.ID, result.Error)
+	}
+
+	return CreatePrice(env, gpu)
 }
 
-func CreatePrice(env *Env, gpu *GPU) {
+// Records the GPU's current price and stock. A new row is only added when the price or stock has changed
+// since the last one, or when the last one is older than the retention heartbeat, so the history shows the
+// GPU was still being tracked.
+func CreatePrice(env *Env, gpu *GPU) error {
+	now := time.Now()
+
+	var last []*Price
+	result := env.DB.Where("gp_uid = ?", gpu.ID).Order("time desc").Limit(1).Find(&last)
+	if result.Error != nil {
+		return fmt.Errorf("could not find last price for GPU %d: %s", gpu.ID, result.Error)
+	}
+	if len(last) > 0 {
+		unchanged := last[0].Price == gpu.Price && last[0].Stock == gpu.Stock
+		if unchanged && now.Sub(last[0].Time) < time.Duration(env.Config.Retention.Heartbeat) {
+			return nil
+		}
+	}
+
 	price := Price{
 		Price: gpu.Price,
 		Stock: gpu.Stock,
 		GPUID: gpu.ID,
-		GPU:   gpu,
-		Time:  time.Now(),
+		Time:  now,
+	}
+	result = env.DB.Create(&price)
+	if result.Error != nil {
+		return fmt.Errorf("could not save price for GPU %d: %s", gpu.ID, result.Error)
 	}
-	env.DB.Create(&price)
+
+	return nil
 }
 
 // Finds a GPU in the database by its ID
@@ -185,24 +470,57 @@ func GetAllGPUs(env *Env) ([]*GPU, error) {
 	return gpus, nil
 }
 
-// Gets the GPUs in the database and compares it to another list of GPUs. Any GPU found in the database
-// but not in the given list will be assumed to be out of stock and will be updated in the database.
-func UpdateMissingGPUs(env *Env, gpu []*GPU) {
+// Gets the GPUs in the database that are not in the given list, which are assumed to be out of stock
+func MissingGPUs(env *Env, gpus []*GPU) ([]*GPU, error) {
 	var dbGPUs []*GPU
-	env.DB.Find(&dbGPUs)
+	result := env.DB.Find(&dbGPUs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
 
+	var missing []*GPU
 	for _, dbGPU := range dbGPUs {
 		found := false
-		for _, gpu := range gpu {
+		for _, gpu := range gpus {
 			if dbGPU.ID == gpu.ID {
 				found = true
 				break
 			}
 		}
 		if !found {
-			log.Println("GPU out of stock: ", dbGPU.ID)
-			dbGPU.Stock = 0
-			env.DB.Save(&dbGPU)
+			missing = append(missing, dbGPU)
 		}
 	}
+
+	return missing, nil
+}
+
+// Gets the GPUs in the database and compares it to another list of GPUs. Any GPU found in the database
+// but not in the given list will be assumed to be out of stock and will be updated in the database, with a
+// price recorded so the history shows when it sold out.
+func UpdateMissingGPUs(env *Env, gpu []*GPU) error {
+	missing, err := MissingGPUs(env, gpu)
+	if err != nil {
+		return fmt.Errorf("could not find missing GPUs: %s", err.Error())
+	}
+
+	for _, dbGPU := range missing {
+		if dbGPU.Stock == 0 {
+			continue
+		}
+
+		log.Println("GPU out of stock: ", dbGPU.ID)
+		dbGPU.Stock = 0
+		result := env.DB.Save(dbGPU)
+		if result.Error != nil {
+			return fmt.Errorf("could not mark GPU %d out of stock: %s", dbGPU.ID, result.Error)
+		}
+
+		err = CreatePrice(env, dbGPU)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Set to a Postgres connection string to run the database tests against that server instead of starting
+// an embedded one
+const testPostgresDSNVariable = "GPUBUD_TEST_POSTGRES_DSN"
+
+// The embedded Postgres server shared by every test in the package. It's started the first time a test
+// needs it and stopped by TestMain.
+var embeddedPostgres struct {
+	once   sync.Once
+	server *embeddedpostgres.EmbeddedPostgres
+	dir    string
+	dsn    string
+	err    error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	if embeddedPostgres.server != nil {
+		embeddedPostgres.server.Stop()
+	}
+	if embeddedPostgres.dir != "" {
+		os.RemoveAll(embeddedPostgres.dir)
+	}
+
+	os.Exit(code)
+}
+
+// Gets a connection string for the test Postgres server, starting the embedded one if no other server is
+// configured. The Postgres binaries are downloaded on first use and cached.
+func postgresTestDSN() (string, error) {
+	if dsn := os.Getenv(testPostgresDSNVariable); dsn != "" {
+		return dsn, nil
+	}
+
+	embeddedPostgres.once.Do(func() {
+		// Ask the OS for a free port so parallel test runs don't collide
+		listener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			embeddedPostgres.err = err
+			return
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+
+		dir, err := os.MkdirTemp("", "gpubud-postgres")
+		if err != nil {
+			embeddedPostgres.err = err
+			return
+		}
+		embeddedPostgres.dir = dir
+
+		server := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+			Port(uint32(port)).
+			RuntimePath(filepath.Join(dir, "runtime")).
+			DataPath(filepath.Join(dir, "data")).
+			Logger(io.Discard))
+		err = server.Start()
+		if err != nil {
+			embeddedPostgres.err = err
+			return
+		}
+
+		embeddedPostgres.server = server
+		embeddedPostgres.dsn = fmt.Sprintf("host=localhost port=%d user=postgres password=postgres dbname=postgres sslmode=disable", port)
+	})
+
+	return embeddedPostgres.dsn, embeddedPostgres.err
+}
+
+// Opens a Postgres database in a schema of its own that is dropped when the test ends. Postgres tests are
+// skipped with -short.
+func openPostgresTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("Postgres tests don't run with -short")
+	}
+
+	dsn, err := postgresTestDSN()
+	if err != nil {
+		t.Fatalf("could not start embedded Postgres, set %s to use another server or run with -short to skip: %s", testPostgresDSNVariable, err.Error())
+	}
+
+	DB, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("could not open database: %s", err.Error())
+	}
+
+	// search_path is set per connection, so only ever use one
+	sqlDB, err := DB.DB()
+	if err != nil {
+		t.Fatalf("could not open database: %s", err.Error())
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	schema := fmt.Sprintf("gpubud_test_%d", time.Now().UnixNano())
+	err = DB.Exec("CREATE SCHEMA " + schema).Error
+	if err == nil {
+		err = DB.Exec("SET search_path TO " + schema).Error
+	}
+	if err != nil {
+		t.Fatalf("could not create test schema: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		DB.Exec("DROP SCHEMA " + schema + " CASCADE")
+		sqlDB.Close()
+	})
+
+	return DB
+}
+
+// Runs test against a migrated SQLite database and a migrated Postgres one
+func forEachDatabase(t *testing.T, test func(t *testing.T, env *Env)) {
+	drivers := []struct {
+		name string
+		open func(t *testing.T) *gorm.DB
+	}{
+		{DriverSQLite, openSQLiteTestDB},
+		{DriverPostgres, openPostgresTestDB},
+	}
+
+	for _, driver := range drivers {
+		t.Run(driver.name, func(t *testing.T) {
+			DB := driver.open(t)
+			err := MigrateDatabase(DB)
+			if err != nil {
+				t.Fatalf("could not migrate database: %s", err.Error())
+			}
+
+			test(t, &Env{DB: DB, Config: DefaultConfig()})
+		})
+	}
+}
+
+// Gets the IDs of GPUs, sorted
+func gpuIDs(gpus []*GPU) []int32 {
+	var ids []int32
+	for _, gpu := range gpus {
+		ids = append(ids, gpu.ID)
+	}
+	slices.Sort(ids)
+
+	return ids
+}
+
+// Gets every price recorded for a GPU, oldest first
+func pricesFor(t *testing.T, env *Env, id int32) []*Price {
+	t.Helper()
+
+	var prices []*Price
+	result := env.DB.Where("gp_uid = ?", id).Order("time").Find(&prices)
+	if result.Error != nil {
+		t.Fatalf("could not read prices: %s", result.Error)
+	}
+
+	return prices
+}
+
+func TestQueryRule(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, env *Env) {
+		gpus := []*GPU{
+			{ID: 101, SKU: "TUF-4070TI", Brand: "NVIDIA", Line: "GeForce RTX", Manufacturer: "ASUS", ProductModel: "4070 Ti"},
+			{ID: 102, SKU: "V-4070", Brand: "NVIDIA", Line: "GeForce RTX", Manufacturer: "MSI", ProductModel: "4070"},
+			{ID: 203, SKU: "N-7900XTX", Brand: "AMD", Line: "Radeon RX", Manufacturer: "Sapphire", ProductModel: "7900 XTX"},
+			{ID: 304, SKU: "A770_16G", Brand: "Intel", Line: "Arc", Manufacturer: "ASRock", ProductModel: "A770"},
+		}
+		for _, gpu := range gpus {
+			result := env.DB.Create(gpu)
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+		}
+
+		tests := []struct {
+			rule ChannelConfigRule
+			want []int32
+		}{
+			{ChannelConfigRule{Query: "4070"}, []int32{101, 102}},
+			// Matching ignores case in every column
+			{ChannelConfigRule{Query: "geforce"}, []int32{101, 102}},
+			{ChannelConfigRule{Query: "msi"}, []int32{102}},
+			{ChannelConfigRule{Query: "XTX"}, []int32{203}},
+			// IDs are matched as text
+			{ChannelConfigRule{Query: "20"}, []int32{203}},
+			// LIKE wildcards in the query match literally
+			{ChannelConfigRule{Query: "A770_"}, []int32{304}},
+			{ChannelConfigRule{Query: "A7%"}, nil},
+			{ChannelConfigRule{Query: "_"}, []int32{304}},
+			// The brand filter applies on top of the query
+			{ChannelConfigRule{Query: "4070", Brand: "AMD"}, nil},
+			{ChannelConfigRule{Query: "asus", Brand: "nvidia"}, []int32{101}},
+		}
+
+		for _, test := range tests {
+			matches, err := QueryRule(env, &test.rule)
+			if err != nil {
+				t.Fatalf("query %q: %s", test.rule.Query, err.Error())
+			}
+
+			if got := gpuIDs(matches); !slices.Equal(got, test.want) {
+				t.Errorf("query %q brand %q: got GPUs %v, want %v", test.rule.Query, test.rule.Brand, got, test.want)
+			}
+		}
+	})
+}
+
+func TestInsertGPUUpserts(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, env *Env) {
+		err := InsertGPU(env, &GPU{ID: 42, Brand: "NVIDIA", ProductModel: "4080", Price: 1199.99, Stock: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = InsertGPU(env, &GPU{ID: 42, Brand: "NVIDIA", ProductModel: "4080 Super", Price: 999.99, Stock: 5})
+		if err != nil {
+			t.Fatalf("could not update GPU: %s", err.Error())
+		}
+
+		var gpus []*GPU
+		env.DB.Find(&gpus)
+		if len(gpus) != 1 {
+			t.Fatalf("got %d GPUs, want 1", len(gpus))
+		}
+		if gpus[0].ProductModel != "4080 Super" || gpus[0].Price != 999.99 || gpus[0].Stock != 5 {
+			t.Errorf("got GPU %+v, want the second insert's values", gpus[0])
+		}
+
+		prices := pricesFor(t, env, 42)
+		if len(prices) != 2 {
+			t.Fatalf("got %d prices, want one per insert", len(prices))
+		}
+		if prices[0].Price != 1199.99 || prices[1].Price != 999.99 {
+			t.Errorf("got prices %v and %v, want 1199.99 and 999.99", prices[0].Price, prices[1].Price)
+		}
+	})
+}
+
+func TestCreatePrice(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, env *Env) {
+		gpu := &GPU{ID: 9, Brand: "AMD", ProductModel: "7800 XT", Price: 499.99, Stock: 4}
+		result := env.DB.Create(gpu)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+
+		steps := []struct {
+			name   string
+			change func()
+			want   int
+		}{
+			{"first price", func() {}, 1},
+			{"unchanged", func() {}, 1},
+			{"price change", func() { gpu.Price = 479.99 }, 2},
+			{"stock change", func() { gpu.Stock = 0 }, 3},
+			{"unchanged again", func() {}, 3},
+			// Once the heartbeat has passed an unchanged price is recorded again
+			{"heartbeat", func() {
+				env.DB.Model(&Price{}).Where("gp_uid = ?", gpu.ID).Update("time", time.Now().Add(-2*time.Duration(env.Config.Retention.Heartbeat)))
+			}, 4},
+		}
+
+		for _, step := range steps {
+			step.change()
+			err := CreatePrice(env, gpu)
+			if err != nil {
+				t.Fatalf("%s: %s", step.name, err.Error())
+			}
+
+			if got := len(pricesFor(t, env, gpu.ID)); got != step.want {
+				t.Errorf("%s: got %d prices, want %d", step.name, got, step.want)
+			}
+		}
+
+		last := pricesFor(t, env, gpu.ID)[3]
+		if last.Price != 479.99 || last.Stock != 0 {
+			t.Errorf("got last price %v with stock %d, want 479.99 with stock 0", last.Price, last.Stock)
+		}
+	})
+}
+
+func TestUpdateMissingGPUsRecordsPrice(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, env *Env) {
+		for _, gpu := range []*GPU{{ID: 1, Price: 299.99, Stock: 3}, {ID: 2, Price: 399.99, Stock: 1}} {
+			err := InsertGPU(env, gpu)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// GPU 2 is no longer listed, so it has sold out
+		err := UpdateMissingGPUs(env, []*GPU{{ID: 1, Price: 299.99, Stock: 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prices := pricesFor(t, env, 2)
+		if len(prices) != 2 || prices[1].Stock != 0 || prices[1].Price != 399.99 {
+			t.Errorf("got prices %+v for the missing GPU, want a second one with stock 0", prices)
+		}
+		if got := len(pricesFor(t, env, 1)); got != 1 {
+			t.Errorf("got %d prices for the listed GPU, want 1", got)
+		}
+	})
+}
+
+func TestPriceHistoryWindow(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, env *Env) {
+		day := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+		rows := []any{
+			&PriceAggregate{GPUID: 5, Resolution: ResolutionDay, BucketStart: day, Min: 590, Max: 610, Close: 600, CloseStock: 2},
+			&PriceAggregate{GPUID: 5, Resolution: ResolutionDay, BucketStart: day.Add(24 * time.Hour), Min: 570, Max: 600, Close: 580, CloseStock: 2},
+			&PriceAggregate{GPUID: 5, Resolution: ResolutionHour, BucketStart: day.Add(48 * time.Hour), Min: 560, Max: 580, Close: 560, CloseStock: 1},
+			&PriceAggregate{GPUID: 5, Resolution: ResolutionHour, BucketStart: day.Add(49 * time.Hour), Min: 550, Max: 560, Close: 550, CloseStock: 1},
+			&Price{GPUID: 5, Price: 540, Stock: 0, Time: day.Add(50 * time.Hour)},
+			&Price{GPUID: 5, Price: 530, Stock: 3, Time: day.Add(51 * time.Hour)},
+			// Another GPU's history is never included
+			&Price{GPUID: 6, Price: 999, Stock: 1, Time: day.Add(50 * time.Hour)},
+		}
+		for _, row := range rows {
+			result := env.DB.Create(row)
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+		}
+
+		tests := []struct {
+			name         string
+			since, until time.Time
+			want         []float64
+		}{
+			{"everything", time.Time{}, day.Add(100 * time.Hour), []float64{600, 580, 560, 550, 540, 530}},
+			// The point before since comes first as the starting price, whichever table it's in
+			{"from a daily aggregate", day.Add(36 * time.Hour), day.Add(100 * time.Hour), []float64{580, 560, 550, 540, 530}},
+			{"from an hourly aggregate", day.Add(49*time.Hour + 30*time.Minute), day.Add(100 * time.Hour), []float64{550, 540, 530}},
+			{"from a price", day.Add(52 * time.Hour), day.Add(100 * time.Hour), []float64{530}},
+			{"until", day.Add(48 * time.Hour), day.Add(50 * time.Hour), []float64{580, 560, 550, 540}},
+			{"before any history", time.Time{}, day.Add(-time.Hour), nil},
+		}
+
+		for _, test := range tests {
+			history, err := PriceHistory(env, 5, test.since, test.until)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err.Error())
+			}
+
+			var got []float64
+			for _, point := range history {
+				got = append(got, point.Price)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("%s: got prices %v, want %v", test.name, got, test.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of events that can be queued for a single subscriber before new events are dropped
+const subscriberBufferSize = 64
+
+// An in-process publish/subscribe hub for GPU differences. The scraper publishes each difference as it
+// is computed and any number of subscribers (such as the /events stream) receive them. Publishing never
+// blocks: if a subscriber's buffer is full the event is dropped for that subscriber only.
+type EventHub struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+// A single listener on an EventHub. Events that pass the filter are delivered on C until the
+// subscription is closed.
+type Subscription struct {
+	C       chan *GPUDifference
+	filter  *DiffFilter
+	hub     *EventHub
+	dropped atomic.Int64
+}
+
+// A set of optional conditions a GPUDifference must meet to be delivered to a subscriber. Empty string
+// fields and zero numeric fields match everything. String fields are matched case-insensitively as substrings.
+type DiffFilter struct {
+	GPUID        int32
+	Brand        string
+	Line         string
+	ProductModel string
+	Manufacturer string
+	MaxPrice     float64
+	ChangedOnly  bool
+}
+
+// Reports whether a difference meets every condition of the filter
+func (f *DiffFilter) Matches(diff *GPUDifference) bool {
+	if f == nil {
+		return true
+	}
+	if f.ChangedOnly && !diff.IsDiff {
+		return false
+	}
+	if f.GPUID != 0 && f.GPUID != diff.GPUID {
+		return false
+	}
+	if f.MaxPrice > 0 && diff.PriceNew > f.MaxPrice {
+		return false
+	}
+	if diff.GPU == nil {
+		return f.Brand == "" && f.Line == "" && f.ProductModel == "" && f.Manufacturer == ""
+	}
+
+	return containsFold(diff.GPU.Brand, f.Brand) &&
+		containsFold(diff.GPU.Line, f.Line) &&
+		containsFold(diff.GPU.ProductModel, f.ProductModel) &&
+		containsFold(diff.GPU.Manufacturer, f.Manufacturer)
+}
+
+func containsFold(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// Registers a new subscriber whose events are limited by filter. A nil filter receives every event.
+func (h *EventHub) Subscribe(filter *DiffFilter) *Subscription {
+	sub := &Subscription{
+		C:      make(chan *GPUDifference, subscriberBufferSize),
+		filter: filter,
+		hub:    h,
+	}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+// Removes the subscription from its hub and closes its channel. Safe to call more than once.
+func (sub *Subscription) Close() {
+	h := sub.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub]; !ok {
+		return
+	}
+	delete(h.subscribers, sub)
+	close(sub.C)
+
+	if dropped := sub.dropped.Load(); dropped > 0 {
+		log.Printf("Event subscriber closed after dropping %d events\n", dropped)
+	}
+}
+
+// Sends a difference to every subscriber whose filter matches it without waiting on slow subscribers
+func (h *EventHub) Publish(diff *GPUDifference) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers {
+		if !sub.filter.Matches(diff) {
+			continue
+		}
+
+		select {
+		case sub.C <- diff:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Closes every subscription, ending any streams that are reading from them
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+// Returns the number of currently registered subscribers
+func (h *EventHub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subscribers)
+}
+
+// Creates an empty EventHub
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
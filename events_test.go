@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDiffFilterMatches(t *testing.T) {
+	asus := &GPUDifference{
+		GPUID:    101,
+		GPU:      &GPU{ID: 101, Brand: "NVIDIA", Line: "GeForce RTX", Manufacturer: "ASUS", ProductModel: "4070 Ti"},
+		PriceNew: 749.99,
+		PriceOld: 799.99,
+		StockNew: 3,
+		StockOld: 3,
+		IsDiff:   true,
+	}
+	unchanged := &GPUDifference{
+		GPUID:    203,
+		GPU:      &GPU{ID: 203, Brand: "AMD", Line: "Radeon RX", Manufacturer: "Sapphire", ProductModel: "7900 XTX"},
+		PriceNew: 899.99,
+		PriceOld: 899.99,
+		StockNew: 1,
+		StockOld: 1,
+	}
+
+	tests := []struct {
+		query string
+		diff  *GPUDifference
+		want  bool
+	}{
+		{"", asus, true},
+		// Unchanged GPUs are only sent with all
+		{"", unchanged, false},
+		{"all=true", unchanged, true},
+		{"all=false", unchanged, false},
+		{"id=101", asus, true},
+		{"id=102", asus, false},
+		// Brands and the other text fields match case-insensitively as substrings
+		{"brand=nvidia", asus, true},
+		{"brand=amd", asus, false},
+		{"model=4070", asus, true},
+		{"manufacturer=sus&line=geforce", asus, true},
+		{"max_price=750", asus, true},
+		{"max_price=700", asus, false},
+		{"brand=amd&all=1&max_price=900", unchanged, true},
+		{"brand=amd&all=1&max_price=850", unchanged, false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/events?"+test.query, nil)
+		filter, err := ParseDiffFilter(r)
+		if err != nil {
+			t.Fatalf("%q: %s", test.query, err.Error())
+		}
+
+		if got := filter.Matches(test.diff); got != test.want {
+			t.Errorf("%q: GPU %d got match %t, want %t", test.query, test.diff.GPUID, got, test.want)
+		}
+	}
+
+	for _, query := range []string{"id=abc", "max_price=cheap", "all=maybe"} {
+		r := httptest.NewRequest(http.MethodGet, "/events?"+query, nil)
+		if _, err := ParseDiffFilter(r); err == nil {
+			t.Errorf("%q: got no error", query)
+		}
+	}
+}
+
+func TestPublishDoesNotBlockOnSlowSubscriber(t *testing.T) {
+	hub := NewEventHub()
+	defer hub.Close()
+
+	// Never reads its events
+	slow := hub.Subscribe(nil)
+	fast := hub.Subscribe(nil)
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range fast.C {
+			n++
+		}
+		received <- n
+	}()
+
+	const events = subscriberBufferSize + 10
+	published := make(chan bool)
+	go func() {
+		for i := range events {
+			hub.Publish(&GPUDifference{GPUID: int32(i), IsDiff: true})
+		}
+		close(published)
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a subscriber that isn't reading")
+	}
+
+	if got := slow.dropped.Load(); got != events-subscriberBufferSize {
+		t.Errorf("slow subscriber dropped %d events, want %d", got, events-subscriberBufferSize)
+	}
+	if got := len(slow.C); got != subscriberBufferSize {
+		t.Errorf("slow subscriber has %d events queued, want %d", got, subscriberBufferSize)
+	}
+
+	fast.Close()
+	if got := <-received; got+int(fast.dropped.Load()) != events {
+		t.Errorf("fast subscriber received %d and dropped %d events, want %d in total", got, fast.dropped.Load(), events)
+	}
+}
+
+func TestCloseEndsEventStreams(t *testing.T) {
+	env := &Env{Events: NewEventHub()}
+	server := httptest.NewServer(http.HandlerFunc(HandleEvents(env)))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?brand=nvidia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+
+	// Wait until the stream has subscribed before publishing
+	if !lines.Scan() || lines.Text() != ": connected" {
+		t.Fatalf("got first line %q, want the connected comment", lines.Text())
+	}
+	if got := env.Events.Count(); got != 1 {
+		t.Fatalf("got %d subscribers, want 1", got)
+	}
+
+	env.Events.Publish(&GPUDifference{GPUID: 203, GPU: &GPU{Brand: "AMD"}, IsDiff: true})
+	env.Events.Publish(&GPUDifference{GPUID: 101, GPU: &GPU{Brand: "NVIDIA"}, IsDiff: true})
+	env.Events.Close()
+
+	// The stream gets the event its filter matches and then ends
+	done := make(chan []string)
+	go func() {
+		var events []string
+		for lines.Scan() {
+			if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+				events = append(events, data)
+			}
+		}
+		done <- events
+	}()
+
+	select {
+	case events := <-done:
+		if len(events) != 1 || !strings.Contains(events[0], `"id":101`) {
+			t.Errorf("got events %v, want only GPU 101", events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream is still open after the hub was closed")
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The version of the export file format written by RunExport. Version 2 added price aggregates; version 1
+// files can still be imported.
+const exportVersion = 2
+
+// How many rows are inserted per statement when importing
+const importBatchSize = 100
+
+// The contents of an export file
+type DataExport struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	GPUs       []*GPU    `json:"gpus"`
+	Prices     []*Price  `json:"prices"`
+	// History the retention job has rolled up, which is no longer in Prices
+	PriceAggregates []*PriceAggregate `json:"price_aggregates"`
+	ChannelConfigs  []*ChannelConfig  `json:"channel_configs"`
+}
+
+// Reads every GPU, price, price aggregate and channel config from the database
+func ExportData(env *Env) (*DataExport, error) {
+	data := &DataExport{
+		Version:    exportVersion,
+		ExportedAt: time.Now().UTC(),
+	}
+
+	result := env.DB.Order("id").Find(&data.GPUs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("could not export GPUs: %s", result.Error)
+	}
+
+	result = env.DB.Order("id").Find(&data.Prices)
+	if result.Error != nil {
+		return nil, fmt.Errorf("could not export prices: %s", result.Error)
+	}
+
+	result = env.DB.Order("id").Find(&data.PriceAggregates)
+	if result.Error != nil {
+		return nil, fmt.Errorf("could not export price aggregates: %s", result.Error)
+	}
+
+	configs, err := LoadChannelConfigs(env)
+	if err != nil {
+		return nil, err
+	}
+	data.ChannelConfigs = configs
+
+	return data, nil
+}
+
+// Rows an import left out because they were already in the database
+type ImportSkipped struct {
+	Prices          int
+	PriceAggregates int
+}
+
+// Loads an export into the database in a single transaction. GPUs are overwritten, prices already
+// recorded for the same GPU and time and aggregates already kept for the same GPU, resolution and bucket
+// are skipped, and channel configs are merged with any existing config for the same channel. Returns how
+// many rows were skipped.
+func ImportData(env *Env, data *DataExport) (*ImportSkipped, error) {
+	if data.Version < 1 || data.Version > exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d, expected 1 to %d", data.Version, exportVersion)
+	}
+
+	skipped := &ImportSkipped{}
+	err := env.DB.Transaction(func(tx *gorm.DB) error {
+		if len(data.GPUs) > 0 {
+			result := tx.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(data.GPUs, importBatchSize)
+			if result.Error != nil {
+				return fmt.Errorf("could not import GPUs: %s", result.Error)
+			}
+		}
+
+		if len(data.Prices) > 0 {
+			prices, n, err := newImportedPrices(tx, data.Prices)
+			if err != nil {
+				return err
+			}
+			skipped.Prices = n
+
+			if len(prices) > 0 {
+				result := tx.CreateInBatches(prices, importBatchSize)
+				if result.Error != nil {
+					return fmt.Errorf("could not import prices: %s", result.Error)
+				}
+			}
+		}
+
+		if len(data.PriceAggregates) > 0 {
+			// New IDs are assigned for the same reason as prices, and the bucket's unique index skips
+			// aggregates that are already kept
+			var aggregates []*PriceAggregate
+			for _, aggregate := range data.PriceAggregates {
+				copied := *aggregate
+				copied.ID = 0
+				aggregates = append(aggregates, &copied)
+			}
+
+			result := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "gpu_id"}, {Name: "resolution"}, {Name: "bucket_start"}},
+				DoNothing: true,
+			}).CreateInBatches(aggregates, importBatchSize)
+			if result.Error != nil {
+				return fmt.Errorf("could not import price aggregates: %s", result.Error)
+			}
+			skipped.PriceAggregates = len(aggregates) - int(result.RowsAffected)
+		}
+
+		for _, imported := range data.ChannelConfigs {
+			err := importChannelConfig(tx, imported)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return skipped, nil
+}
+
+// Copies the imported prices that aren't already recorded, along with how many were skipped. A price is
+// identified by its GPU and time, since IDs from another database could collide with unrelated rows. The
+// copies have no ID so the database assigns new ones.
+func newImportedPrices(tx *gorm.DB, imported []*Price) ([]*Price, int, error) {
+	key := func(gpuID int32, t time.Time) string {
+		return fmt.Sprintf("%d/%d", gpuID, t.UnixMicro())
+	}
+
+	var gpuIDs []int32
+	seenGPU := make(map[int32]bool)
+	for _, price := range imported {
+		if !seenGPU[price.GPUID] {
+			seenGPU[price.GPUID] = true
+			gpuIDs = append(gpuIDs, price.GPUID)
+		}
+	}
+
+	var existing []*Price
+	result := tx.Select("gp_uid", "time").Where("gp_uid IN ?", gpuIDs).Find(&existing)
+	if result.Error != nil {
+		return nil, 0, fmt.Errorf("could not import prices: %s", result.Error)
+	}
+	recorded := make(map[string]bool)
+	for _, price := range existing {
+		recorded[key(price.GPUID, price.Time)] = true
+	}
+
+	var prices []*Price
+	skipped := 0
+	for _, price := range imported {
+		k := key(price.GPUID, price.Time)
+		if recorded[k] {
+			skipped++
+			continue
+		}
+		recorded[k] = true
+
+		prices = append(prices, &Price{
+			Model: gorm.Model{CreatedAt: price.CreatedAt, UpdatedAt: price.UpdatedAt},
+			Price: price.Price,
+			Stock: price.Stock,
+			GPUID: price.GPUID,
+			Time:  price.Time,
+		})
+	}
+
+	return prices, skipped, nil
+}
+
+// Adds an imported channel config's rules to the existing config for its channel, or creates it
+func importChannelConfig(tx *gorm.DB, imported *ChannelConfig) error {
+	var existing ChannelConfig
+	result := tx.Preload(clause.Associations).Where("channel_id = ?", imported.ChannelID).Limit(1).Find(&existing)
+	if result.Error != nil {
+		return fmt.Errorf("could not import channel config %s: %s", imported.ChannelID, result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		// IDs from another database could collide with existing rows, so let the database assign new ones
+		config := &ChannelConfig{ChannelID: imported.ChannelID, Subscribed: imported.Subscribed}
+		for _, rule := range imported.Rules {
+			config.Rules = append(config.Rules, &ChannelConfigRule{Query: rule.Query, MaxPrice: rule.MaxPrice, Brand: rule.Brand, Event: rule.Event})
+		}
+
+		result = tx.Create(config)
+		if result.Error != nil {
+			return fmt.Errorf("could not import channel config %s: %s", imported.ChannelID, result.Error)
+		}
+		return nil
+	}
+
+	existing.Subscribed = existing.Subscribed || imported.Subscribed
+	for _, rule := range imported.Rules {
+		found := false
+		for _, r := range existing.Rules {
+			if r.Query == rule.Query {
+				found = true
+				break
+			}
+		}
+		if !found {
+			existing.Rules = append(existing.Rules, &ChannelConfigRule{Query: rule.Query, MaxPrice: rule.MaxPrice, Brand: rule.Brand, Event: rule.Event})
+		}
+	}
+
+	result = tx.Save(&existing)
+	if result.Error != nil {
+		return fmt.Errorf("could not import channel config %s: %s", imported.ChannelID, result.Error)
+	}
+
+	return nil
+}
+
+// Writes every GPU, price and channel config to a JSON file, or stdout if no file is given
+//
+//	gpubud export -o backup.json
+func RunExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "", "file to write the export to (default stdout)")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	data, err := ExportData(env)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("could not create export file: %s", err.Error())
+		}
+		defer f.Close()
+		w = f
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(data)
+	if err != nil {
+		return fmt.Errorf("could not write export: %s", err.Error())
+	}
+
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "Exported %d GPUs, %d prices, %d price aggregates and %d channel configs to %s\n", len(data.GPUs), len(data.Prices), len(data.PriceAggregates), len(data.ChannelConfigs), *output)
+	}
+	return nil
+}
+
+// Loads a file written by export into the database, reading stdin if no file is given
+//
+//	gpubud import -i backup.json
+func RunImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	input := fs.String("i", "", "file to read the export from (default stdin)")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return fmt.Errorf("could not open export file: %s", err.Error())
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var data DataExport
+	err = json.NewDecoder(r).Decode(&data)
+	if err != nil {
+		return fmt.Errorf("could not read export: %s", err.Error())
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	skipped, err := ImportData(env, &data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d GPUs, %d prices, %d price aggregates and %d channel configs\n", len(data.GPUs), len(data.Prices)-skipped.Prices, len(data.PriceAggregates)-skipped.PriceAggregates, len(data.ChannelConfigs))
+	if skipped.Prices > 0 || skipped.PriceAggregates > 0 {
+		fmt.Printf("Skipped %d prices and %d price aggregates that were already recorded\n", skipped.Prices, skipped.PriceAggregates)
+	}
+	return nil
+}
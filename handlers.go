@@ -1,11 +1,96 @@
 package main
 
 import (
-	"html/template"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// How often a comment is sent on idle event streams to keep proxies from closing the connection
+const eventKeepAliveInterval = 30 * time.Second
+
+// The JSON payload sent to clients of the /events stream for each GPUDifference
+type GPUEvent struct {
+	GPUID        int32   `json:"id"`
+	Name         string  `json:"name"`
+	Brand        string  `json:"brand"`
+	Line         string  `json:"line"`
+	ProductModel string  `json:"model"`
+	Manufacturer string  `json:"manufacturer"`
+	Link         string  `json:"link"`
+	PriceNew     float64 `json:"price_new"`
+	PriceOld     float64 `json:"price_old"`
+	StockNew     int32   `json:"stock_new"`
+	StockOld     int32   `json:"stock_old"`
+	IsDiff       bool    `json:"is_diff"`
+	PriceDrop    bool    `json:"price_drop"`
+}
+
+func NewGPUEvent(diff *GPUDifference) *GPUEvent {
+	event := &GPUEvent{
+		GPUID:     diff.GPUID,
+		PriceNew:  diff.PriceNew,
+		PriceOld:  diff.PriceOld,
+		StockNew:  diff.StockNew,
+		StockOld:  diff.StockOld,
+		IsDiff:    diff.IsDiff,
+		PriceDrop: diff.PriceOld > 0 && diff.PriceNew < diff.PriceOld,
+	}
+
+	if diff.GPU != nil {
+		event.Name = diff.GPU.Name
+		event.Brand = diff.GPU.Brand
+		event.Line = diff.GPU.Line
+		event.ProductModel = diff.GPU.ProductModel
+		event.Manufacturer = diff.GPU.Manufacturer
+		event.Link = diff.GPU.Link
+	}
+
+	return event
+}
+
+// Builds a DiffFilter from the query parameters of an /events request. Supported parameters are
+// id, brand, line, model, manufacturer, max_price and all (send unchanged GPUs as well).
+func ParseDiffFilter(r *http.Request) (*DiffFilter, error) {
+	q := r.URL.Query()
+	filter := &DiffFilter{
+		Brand:        q.Get("brand"),
+		Line:         q.Get("line"),
+		ProductModel: q.Get("model"),
+		Manufacturer: q.Get("manufacturer"),
+		ChangedOnly:  true,
+	}
+
+	if v := q.Get("id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %s", v)
+		}
+		filter.GPUID = int32(id)
+	}
+
+	if v := q.Get("max_price"); v != "" {
+		maxPrice, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_price: %s", v)
+		}
+		filter.MaxPrice = maxPrice
+	}
+
+	if v := q.Get("all"); v != "" {
+		all, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid all: %s", v)
+		}
+		filter.ChangedOnly = !all
+	}
+
+	return filter, nil
+}
+
 func HandleRoot(env *Env) func(w http.ResponseWriter, r *http.Request) {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		gpus, err := GetAllGPUs(env)
@@ -15,11 +100,144 @@ func HandleRoot(env *Env) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		tmpl := template.Must(template.ParseFiles("./templates/index.html"))
 		tmpl_data := map[string][]*GPU{
 			"GPUs": gpus,
 		}
-		tmpl.Execute(w, tmpl_data)
+		err = env.Templates.Render(w, "index", tmpl_data)
+		if err != nil {
+			log.Println("error in route root: ", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	return handler
+}
+
+// Returns every GPU in the database as JSON
+func HandleAPIGPUs(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		gpus, err := GetAllGPUs(env)
+		if err != nil {
+			log.Println("error in route api gpus: ", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(gpus)
+		if err != nil {
+			log.Println("error in route api gpus: ", err.Error())
+		}
+	}
+
+	return handler
+}
+
+// Returns the status of every UpdateManager job as JSON
+func HandleAPIJobs(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(env.UpdateManager.Status())
+		if err != nil {
+			log.Println("error in route api jobs: ", err.Error())
+		}
+	}
+
+	return handler
+}
+
+// Triggers, pauses, resumes or changes the interval of an UpdateManager job. The interval action takes an
+// "interval" form value of at least 1m in Go duration format, such as 10m.
+func HandleAPIJobAction(env *Env, action string) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		var err error
+		switch action {
+		case "trigger":
+			err = env.UpdateManager.Trigger(name)
+		case "pause":
+			err = env.UpdateManager.SetPaused(name, true)
+		case "resume":
+			err = env.UpdateManager.SetPaused(name, false)
+		case "interval":
+			var d time.Duration
+			d, err = time.ParseDuration(r.FormValue("interval"))
+			if err == nil {
+				err = env.UpdateManager.SetInterval(name, d)
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, status := range env.UpdateManager.Status() {
+			if status.Name != name {
+				continue
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(status)
+			if err != nil {
+				log.Println("error in route api job action: ", err.Error())
+			}
+		}
+	}
+
+	return handler
+}
+
+// Streams GPU differences to the client as Server-Sent Events as they are produced by the scraper
+func HandleEvents(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		filter, err := ParseDiffFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sub := env.Events.Subscribe(filter)
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": connected\n\n")
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case diff, ok := <-sub.C:
+				if !ok {
+					return
+				}
+
+				data, err := json.Marshal(NewGPUEvent(diff))
+				if err != nil {
+					log.Println("error in route events: ", err.Error())
+					continue
+				}
+
+				fmt.Fprintf(w, "event: gpu\ndata: %s\n\n", data)
+				flusher.Flush()
+			}
+		}
 	}
 
 	return handler
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How long after the last successful scrape the scraper is considered stale. A scrape can come up to
+// the longest gap in its schedule plus jitter after the last one, so allowing twice that tolerates one
+// failed scrape.
+func ScrapeStaleThreshold(schedule Schedule, jitter time.Duration) time.Duration {
+	_, longest := scheduleGaps(schedule, time.Now(), 16)
+	return 2 * (longest + jitter)
+}
+
+// How long a database ping may take before the database is reported as down
+const healthCheckTimeout = 2 * time.Second
+
+// Status values for a single health check
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// The result of one component's health check
+type HealthCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// The JSON body returned by /healthz and /readyz
+type HealthReport struct {
+	Status         string                  `json:"status"`
+	Uptime         string                  `json:"uptime"`
+	LastScrapeTime *time.Time              `json:"last_scrape_time"`
+	Checks         map[string]*HealthCheck `json:"checks"`
+	Jobs           []JobStatus             `json:"jobs"`
+}
+
+func checkDatabase(ctx context.Context, env *Env) *HealthCheck {
+	db, err := env.DB.DB()
+	if err != nil {
+		return &HealthCheck{Status: HealthFail, Message: err.Error()}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		return &HealthCheck{Status: HealthFail, Message: err.Error()}
+	}
+
+	return &HealthCheck{Status: HealthOK}
+}
+
+func checkDiscord(env *Env) *HealthCheck {
+	if env.DiscordBot == nil || !env.DiscordBot.Connected() {
+		return &HealthCheck{Status: HealthFail, Message: "not connected to discord gateway"}
+	}
+
+	return &HealthCheck{Status: HealthOK}
+}
+
+func checkScraper(env *Env) *HealthCheck {
+	last := env.GetLastScrapeTime()
+	if last.IsZero() {
+		// Give the first scrape a chance to finish before reporting the scraper as broken
+		if time.Since(env.StartTime) < env.ScrapeStaleThreshold {
+			return &HealthCheck{Status: HealthOK, Message: fmt.Sprintf("waiting for first scrape, threshold is %s", env.ScrapeStaleThreshold)}
+		}
+		return &HealthCheck{Status: HealthFail, Message: fmt.Sprintf("no successful scrape since startup, threshold is %s", env.ScrapeStaleThreshold)}
+	}
+
+	since := time.Since(last).Round(time.Second)
+	if since > env.ScrapeStaleThreshold {
+		return &HealthCheck{Status: HealthFail, Message: fmt.Sprintf("last successful scrape was %s ago, threshold is %s", since, env.ScrapeStaleThreshold)}
+	}
+
+	return &HealthCheck{Status: HealthOK, Message: fmt.Sprintf("last successful scrape was %s ago, threshold is %s", since, env.ScrapeStaleThreshold)}
+}
+
+// Runs every health check. Liveness only depends on the database, since restarting the process won't fix
+// Discord or the retailer's website being down; readiness depends on every check.
+func BuildHealthReport(ctx context.Context, env *Env, readiness bool) *HealthReport {
+	report := &HealthReport{
+		Status: HealthOK,
+		Uptime: time.Since(env.StartTime).Round(time.Second).String(),
+		Checks: map[string]*HealthCheck{
+			"database": checkDatabase(ctx, env),
+			"discord":  checkDiscord(env),
+			"scraper":  checkScraper(env),
+		},
+	}
+
+	if last := env.GetLastScrapeTime(); !last.IsZero() {
+		report.LastScrapeTime = &last
+	}
+
+	if env.UpdateManager != nil {
+		report.Jobs = env.UpdateManager.Status()
+	}
+
+	critical := []string{"database"}
+	if readiness {
+		critical = []string{"database", "discord", "scraper"}
+	}
+	for _, name := range critical {
+		if report.Checks[name].Status != HealthOK {
+			report.Status = HealthFail
+		}
+	}
+
+	return report
+}
+
+// Serves a JSON health report with a 200 status when healthy and 503 otherwise. When readiness is true
+// every component must be healthy, otherwise only the database is required.
+func HandleHealth(env *Env, readiness bool) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		report := BuildHealthReport(r.Context(), env, readiness)
+
+		code := http.StatusOK
+		if report.Status != HealthOK {
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		err := json.NewEncoder(w).Encode(report)
+		if err != nil {
+			log.Println("error in route health: ", err.Error())
+		}
+	}
+
+	return handler
+}
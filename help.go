@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Example uses of each command shown by /help. Everything else in the help is read from the registered
+// commands, so it can't drift from what Discord shows.
+var commandExamples = map[string][]string{
+	"subscribe":   {"/subscribe"},
+	"unsubscribe": {"/unsubscribe"},
+	"rules":       {"/rules"},
+	"add-rule":    {"/add-rule query:4070 Ti", "/add-rule query:7900 XTX max-price:850 event:price_drop", "/add-rule", "/add-rule brand:AMD"},
+	"remove-rule": {"/remove-rule"},
+	"list":        {"/list"},
+	"price":       {"/price query:4070 Ti", "/price query:123456"},
+	"backtest":    {"/backtest query:4070", "/backtest query:RX 7800 days:90 event:restock"},
+	"jobs":        {"/jobs list", "/jobs run job:scrape", "/jobs interval job:scrape every:10m"},
+	"help":        {"/help", "/help command:add-rule"},
+}
+
+func init() {
+	// The help command lists the other commands as choices, so it's added once they are all defined
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	for _, command := range commands {
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: command.Name, Value: command.Name})
+	}
+
+	commands = append(commands, &discordgo.ApplicationCommand{
+		Name:        "help",
+		Description: "Explains GPU Bud's commands",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "command",
+				Description: "A command to explain in detail",
+				Choices:     choices,
+			},
+		},
+	})
+}
+
+// Finds a registered command by name
+func findCommand(name string) (*discordgo.ApplicationCommand, bool) {
+	for _, command := range commands {
+		if command.Name == name {
+			return command, true
+		}
+	}
+
+	return nil, false
+}
+
+// Describes the permission a command needs, or an empty string if anyone can use it
+func commandPermission(command *discordgo.ApplicationCommand) string {
+	if operatorCommands[command.Name] {
+		return "Bot operator"
+	}
+	if command.DefaultMemberPermissions != nil && *command.DefaultMemberPermissions&discordgo.PermissionAdministrator != 0 {
+		return "Administrator"
+	}
+
+	return ""
+}
+
+// Describes how to call a command or subcommand with its options, such as
+// "/backtest query:<text> [days:<integer>]"
+func commandUsage(name string, options []*discordgo.ApplicationCommandOption) string {
+	usage := "/" + name
+	for _, option := range options {
+		if option.Type == discordgo.ApplicationCommandOptionSubCommand {
+			continue
+		}
+
+		arg := fmt.Sprintf("%s:<%s>", option.Name, optionTypeName(option.Type))
+		if !option.Required {
+			arg = "[" + arg + "]"
+		}
+		usage += " " + arg
+	}
+
+	return usage
+}
+
+// The kind of value an option takes, as shown in usage lines
+func optionTypeName(t discordgo.ApplicationCommandOptionType) string {
+	switch t {
+	case discordgo.ApplicationCommandOptionInteger:
+		return "integer"
+	case discordgo.ApplicationCommandOptionNumber:
+		return "number"
+	case discordgo.ApplicationCommandOptionBoolean:
+		return "true/false"
+	case discordgo.ApplicationCommandOptionChannel:
+		return "channel"
+	default:
+		return "text"
+	}
+}
+
+// Describes each option of a command on its own line
+func optionLines(options []*discordgo.ApplicationCommandOption) string {
+	var lines []string
+	for _, option := range options {
+		if option.Type == discordgo.ApplicationCommandOptionSubCommand {
+			continue
+		}
+
+		line := fmt.Sprintf("`%s` %s", option.Name, option.Description)
+		if option.Required {
+			line += " (required)"
+		}
+		if len(option.Choices) > 0 {
+			var values []string
+			for _, choice := range option.Choices {
+				values = append(values, fmt.Sprintf("`%v`", choice.Value))
+			}
+			line += ": " + strings.Join(values, ", ")
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Builds the help embed listing every command
+func HelpOverviewEmbed() *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title:       "GPU Bud commands",
+		Description: "Use `/help command:<name>` for a command's options and examples",
+	}
+
+	for _, command := range commands {
+		value := command.Description
+		if permission := commandPermission(command); permission != "" {
+			value += fmt.Sprintf("\n*Needs %s*", permission)
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  "/" + command.Name,
+			Value: value,
+		})
+	}
+
+	return embed
+}
+
+// Builds the help embed explaining one command: its usage, options, subcommands, examples and the
+// permission it needs
+func CommandHelpEmbed(command *discordgo.ApplicationCommand) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title:       "/" + command.Name,
+		Description: command.Description,
+	}
+	addField := func(name, value string) {
+		if value != "" {
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: name, Value: value})
+		}
+	}
+
+	var usages []string
+	var subcommands []string
+	for _, option := range command.Options {
+		if option.Type != discordgo.ApplicationCommandOptionSubCommand {
+			continue
+		}
+
+		usage := commandUsage(command.Name+" "+option.Name, option.Options)
+		usages = append(usages, fmt.Sprintf("`%s`", usage))
+		subcommands = append(subcommands, fmt.Sprintf("`%s` %s", option.Name, option.Description))
+	}
+	if len(usages) == 0 {
+		usages = append(usages, fmt.Sprintf("`%s`", commandUsage(command.Name, command.Options)))
+	}
+
+	addField("Usage", strings.Join(usages, "\n"))
+	addField("Options", optionLines(command.Options))
+	addField("Subcommands", strings.Join(subcommands, "\n"))
+
+	var examples []string
+	for _, example := range commandExamples[command.Name] {
+		examples = append(examples, fmt.Sprintf("`%s`", example))
+	}
+	addField("Examples", strings.Join(examples, "\n"))
+
+	permission := commandPermission(command)
+	if permission == "" {
+		permission = "None"
+	}
+	addField("Permission needed", permission)
+
+	return embed
+}
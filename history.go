@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// One point in a GPU's price history
+type PricePoint struct {
+	Time  time.Time
+	Price float64
+	Stock int32
+	// The lowest and highest price over the hour or day an aggregate covers. Equal to Price for
+	// prices that haven't been rolled up yet.
+	Min float64
+	Max float64
+}
+
+// Gets a GPU's price history between since and until, oldest first. The last point before since is
+// included at the start, at its own time, since it holds the price in effect when the window began.
+// History that the retention job has rolled up is represented by one point per hourly or daily aggregate,
+// at the start of its bucket and with its close as the price.
+func PriceHistory(env *Env, gpuID int32, since, until time.Time) ([]*PricePoint, error) {
+	var points []*PricePoint
+	var before *PricePoint
+	var after time.Time
+
+	for _, res := range []struct {
+		name   string
+		length time.Duration
+	}{{ResolutionDay, 24 * time.Hour}, {ResolutionHour, time.Hour}} {
+		var earlier []*PriceAggregate
+		result := env.DB.Where("gpu_id = ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ?", gpuID, res.name, after, since).Order("bucket_start DESC").Limit(1).Find(&earlier)
+		if result.Error != nil {
+			return nil, fmt.Errorf("could not load price history: %s", result.Error)
+		}
+		for _, agg := range earlier {
+			before = aggregatePoint(agg)
+			after = agg.BucketStart.Add(res.length)
+		}
+
+		var aggregates []*PriceAggregate
+		result = env.DB.Where("gpu_id = ? AND resolution = ? AND bucket_start >= ? AND bucket_start <= ?", gpuID, res.name, laterOf(after, since), until).Order("bucket_start").Find(&aggregates)
+		if result.Error != nil {
+			return nil, fmt.Errorf("could not load price history: %s", result.Error)
+		}
+
+		for _, agg := range aggregates {
+			points = append(points, aggregatePoint(agg))
+			// Finer data only starts after the coarser data ends
+			after = agg.BucketStart.Add(res.length)
+		}
+	}
+
+	var earlier []*Price
+	result := env.DB.Where("gp_uid = ? AND time >= ? AND time < ?", gpuID, after, since).Order("time DESC").Limit(1).Find(&earlier)
+	if result.Error != nil {
+		return nil, fmt.Errorf("could not load price history: %s", result.Error)
+	}
+	for _, p := range earlier {
+		before = pricePoint(p)
+	}
+
+	var prices []*Price
+	result = env.DB.Where("gp_uid = ? AND time >= ? AND time <= ?", gpuID, laterOf(after, since), until).Order("time").Find(&prices)
+	if result.Error != nil {
+		return nil, fmt.Errorf("could not load price history: %s", result.Error)
+	}
+
+	for _, p := range prices {
+		points = append(points, pricePoint(p))
+	}
+
+	if before != nil {
+		points = append([]*PricePoint{before}, points...)
+	}
+
+	return points, nil
+}
+
+// The point for an hourly or daily aggregate
+func aggregatePoint(agg *PriceAggregate) *PricePoint {
+	return &PricePoint{Time: agg.BucketStart, Price: agg.Close, Stock: agg.CloseStock, Min: agg.Min, Max: agg.Max}
+}
+
+// The point for a price that hasn't been rolled up
+func pricePoint(p *Price) *PricePoint {
+	return &PricePoint{Time: p.Time, Price: p.Price, Stock: p.Stock, Min: p.Price, Max: p.Price}
+}
+
+// Gets whichever of two times is later
+func laterOf(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
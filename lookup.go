@@ -0,0 +1,86 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many days of history /price shows
+const priceLookupDays = 30
+
+// Most listings /price shows at once. Each one needs its own line color and emoji in the chart.
+const maxPriceListings = len(chartSeries)
+
+// A GPU's current listing along with its recent price history
+type PriceSummary struct {
+	GPU *GPU
+	// The lowest and highest price over the window
+	Low  float64
+	High float64
+	// The window's price points, oldest first. The price in effect when the window began is included
+	// at its start.
+	History []*PricePoint
+}
+
+// Finds the GPUs matching query, as a rule with that query would, and summarizes their prices between
+// since and until. A GPU whose ID is the query comes first, then GPUs in stock, cheapest first. At most
+// limit summaries are returned, along with the total number of matches.
+func LookupPrices(env *Env, query string, since, until time.Time, limit int) ([]*PriceSummary, int, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, 0, fmt.Errorf("a model or ID is required")
+	}
+
+	gpus, err := QueryRule(env, &ChannelConfigRule{Query: query})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id, idErr := strconv.Atoi(query)
+	slices.SortFunc(gpus, func(a, b *GPU) int {
+		if idErr == nil && (int(a.ID) == id) != (int(b.ID) == id) {
+			if int(a.ID) == id {
+				return -1
+			}
+			return 1
+		}
+		if (a.Stock > 0) != (b.Stock > 0) {
+			if a.Stock > 0 {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.Price, b.Price)
+	})
+
+	var summaries []*PriceSummary
+	for _, gpu := range gpus[:min(limit, len(gpus))] {
+		history, err := PriceHistory(env, gpu.ID, since, until)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		summary := &PriceSummary{GPU: gpu, Low: gpu.Price, High: gpu.Price}
+		for _, point := range history {
+			// The price in effect when the window began is moved to its start, without the range it had
+			// before then
+			if point.Time.Before(since) {
+				point = &PricePoint{Time: since, Price: point.Price, Stock: point.Stock, Min: point.Price, Max: point.Price}
+			}
+			summary.History = append(summary.History, point)
+		}
+
+		for _, point := range summary.History {
+			summary.Low = min(summary.Low, point.Min)
+			summary.High = max(summary.High, point.Max)
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, len(gpus), nil
+}
@@ -1,27 +1,42 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+// How long in-flight work is given to finish after a shutdown signal
+const shutdownTimeout = 30 * time.Second
+
 type Env struct {
-	DB              *gorm.DB
-	DiscordBot      *DiscordBot
-	ChannelConfigs  []*ChannelConfig
-	LastScrapeTime  time.Time
-	RunUpdateLoop   bool
-	UpdateManager   *UpdateManager
-	MicrocenterUrl  string
-	DiscordBotToken string
+	DB             *gorm.DB
+	DiscordBot     *DiscordBot
+	ChannelConfigs []*ChannelConfig
+	LastScrapeTime time.Time
+	StartTime      time.Time
+	RunUpdateLoop  bool
+	UpdateManager  *UpdateManager
+	Events         *EventHub
+	Templates      *Renderer
+	Config         *Config
+	// How long after the last successful scrape /readyz reports the scraper as stale
+	ScrapeStaleThreshold time.Duration
+	scrapeTimeMu         sync.RWMutex
 }
 
 func GetEnvironmentVariable(v string) (string, error) {
@@ -37,39 +52,90 @@ func SendDiscordMessage(s *discordgo.Session, message string) {
 	s.UserGuilds(200, "", "", false)
 }
 
-func InitEnvironment() (*Env, error) {
-	// Get environment variables from OS
-	microcenterUrl, err := GetEnvironmentVariable("MICROCENTER_URL")
+// Opens the configured database and applies any pending migrations. Refuses to open a database whose schema
+// is newer than this build.
+func OpenDatabase(cfg DatabaseConfig) (*gorm.DB, error) {
+	DB, err := ConnectDatabase(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error in initialization: %s", err.Error())
+		return nil, err
+	}
+
+	err = MigrateDatabase(DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return DB, nil
+}
+
+// Opens the configured database without changing its schema
+func ConnectDatabase(cfg DatabaseConfig) (*gorm.DB, error) {
+	switch cfg.Driver {
+	case DriverPostgres:
+		return gorm.Open(postgres.Open(cfg.DSN), &gorm.Config{})
+	case DriverSQLite, "":
+		return gorm.Open(sqlite.Open(cfg.Path), &gorm.Config{})
 	}
 
-	discordBotToken, err := GetEnvironmentVariable("DISCORD_BOT_TOKEN")
+	return nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+}
+
+func InitEnvironment(cfg *Config) (*Env, error) {
+	err := cfg.ValidateServe()
 	if err != nil {
 		return nil, fmt.Errorf("error in initialization: %s", err.Error())
 	}
 
 	// Open and run migrations for database
-	DB, err := gorm.Open(sqlite.Open("gpubud.db"), &gorm.Config{})
+	DB, err := OpenDatabase(cfg.Database)
 	if err != nil {
 		return nil, fmt.Errorf("error in initialization: %s", err.Error())
 	}
 
-	DB.AutoMigrate(&GPU{}, &Price{}, &ChannelConfig{}, &ChannelConfigRule{})
+	// Parse web templates
+	templates, err := NewRenderer(cfg.HTTP.Dev)
+	if err != nil {
+		return nil, fmt.Errorf("error in initialization: %s", err.Error())
+	}
 
 	// Setup Env struct
 	env := &Env{
-		DB:              DB,
-		LastScrapeTime:  time.Now(),
-		RunUpdateLoop:   true,
-		MicrocenterUrl:  microcenterUrl,
-		DiscordBotToken: discordBotToken,
+		DB:            DB,
+		StartTime:     time.Now(),
+		RunUpdateLoop: true,
+		Events:        NewEventHub(),
+		Templates:     templates,
+		Config:        cfg,
 	}
 
-	// Setup Update Manager
-	env.UpdateManager = NewUpdateManager(env, 5*time.Minute)
-	env.UpdateManager.Add(Scrape)
-	env.UpdateManager.Add(ReportGPUData)
+	// Setup Update Manager. Jobs run on the schedules set under jobs in the config, or their defaults.
+	env.UpdateManager = NewUpdateManager(env, time.Duration(cfg.Scraper.Interval))
+	scrapeSchedule := cfg.JobSchedule("scrape", Every(time.Duration(cfg.Scraper.Interval)))
+	// The threshold follows the scrape schedule so long intervals aren't reported as stale
+	env.ScrapeStaleThreshold = ScrapeStaleThreshold(scrapeSchedule, time.Duration(cfg.Scraper.Jitter))
+	err = env.UpdateManager.Add("scrape", Scrape, JobOptions{Schedule: scrapeSchedule, Jitter: time.Duration(cfg.Scraper.Jitter)})
+	if err != nil {
+		return nil, fmt.Errorf("error in initialization: %s", err.Error())
+	}
+
+	err = env.UpdateManager.Add("report", ReportGPUData, JobOptions{After: []string{"scrape"}})
+	if err != nil {
+		return nil, fmt.Errorf("error in initialization: %s", err.Error())
+	}
+
+	err = env.UpdateManager.Add("retention", ApplyRetention, JobOptions{Schedule: cfg.JobSchedule("retention", Every(time.Hour))})
+	if err != nil {
+		return nil, fmt.Errorf("error in initialization: %s", err.Error())
+	}
+
+	// A schedule under jobs turns backups on even if backup.interval is 0
+	_, backupScheduled := cfg.Jobs["backup"]
+	if cfg.Database.Driver == DriverSQLite && (cfg.Backup.Interval > 0 || backupScheduled) {
+		err = env.UpdateManager.Add("backup", ScheduledBackup, JobOptions{Schedule: cfg.JobSchedule("backup", Every(time.Duration(cfg.Backup.Interval)))})
+		if err != nil {
+			return nil, fmt.Errorf("error in initialization: %s", err.Error())
+		}
+	}
 
 	// Setup Discord Bot
 	configs, err := LoadChannelConfigs(env)
@@ -83,7 +149,7 @@ func InitEnvironment() (*Env, error) {
 	}
 
 	bot, err := NewDiscordBot(&DiscordBotConfig{
-		Token:            discordBotToken,
+		Token:            cfg.Discord.Token,
 		NotifierChannels: cfMap,
 		Env:              env,
 	})
@@ -97,26 +163,129 @@ func InitEnvironment() (*Env, error) {
 }
 
 func main() {
-	log.Println("Initializing environment")
-	env, err := InitEnvironment()
+	// Starting the server is the default so running gpubud with just flags keeps working
+	command := RunServe
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if c, ok := cliCommands[args[0]]; ok {
+			command = c
+			args = args[1:]
+		}
+	}
+
+	err := command(args)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+}
+
+// Starts the scraper, Discord bot and web server and runs until interrupted
+//
+//	gpubud serve -config gpubud.yaml
+func RunServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Initializing environment")
+	env, err := InitEnvironment(cfg)
+	if err != nil {
+		return err
+	}
 
 	log.Println("Starting server")
 	http.HandleFunc("/", HandleRoot(env))
+	http.HandleFunc("/events", HandleEvents(env))
+	http.Handle("GET /metrics", promhttp.Handler())
+	http.HandleFunc("GET /healthz", HandleHealth(env, false))
+	http.HandleFunc("GET /readyz", HandleHealth(env, true))
+	http.HandleFunc("GET /login", HandleLoginPage(env))
+	http.HandleFunc("POST /login", HandleLogin(env))
+	http.HandleFunc("POST /logout", HandleLogout(env))
+	http.HandleFunc("GET /api/gpus", RequireScope(env, ScopeGPUsRead, HandleAPIGPUs(env)))
+	http.HandleFunc("GET /api/prices/export", RequireScope(env, ScopeGPUsRead, HandleAPIPriceExport(env)))
+	http.HandleFunc("GET /api/jobs", RequireScope(env, ScopeAdmin, HandleAPIJobs(env)))
+	http.HandleFunc("POST /api/jobs/{name}/trigger", RequireScope(env, ScopeAdmin, HandleAPIJobAction(env, "trigger")))
+	http.HandleFunc("POST /api/jobs/{name}/pause", RequireScope(env, ScopeAdmin, HandleAPIJobAction(env, "pause")))
+	http.HandleFunc("POST /api/jobs/{name}/resume", RequireScope(env, ScopeAdmin, HandleAPIJobAction(env, "resume")))
+	http.HandleFunc("POST /api/jobs/{name}/interval", RequireScope(env, ScopeAdmin, HandleAPIJobAction(env, "interval")))
+	http.HandleFunc("GET /admin/{$}", RequireAdmin(env, HandleAdminIndex(env)))
+	http.HandleFunc("POST /admin/channels/{channel}/subscription", RequireAdmin(env, HandleAdminSubscription(env)))
+	http.HandleFunc("POST /admin/channels/{channel}/rules", RequireAdmin(env, HandleAdminAddRule(env)))
+	http.HandleFunc("POST /admin/channels/{channel}/rules/edit", RequireAdmin(env, HandleAdminEditRule(env)))
+	http.HandleFunc("POST /admin/channels/{channel}/rules/remove", RequireAdmin(env, HandleAdminRemoveRule(env)))
+	http.HandleFunc("GET /admin/channels/{channel}/rules/test", RequireAdmin(env, HandleAdminTestRule(env)))
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(env.Templates.Static()))))
 
 	env.UpdateManager.Start()
 	env.UpdateManager.UpdateNow()
 
-	env.DiscordBot.Open()
-	defer env.DiscordBot.Close()
+	err = env.DiscordBot.Open()
+	if err != nil {
+		log.Println(err.Error())
+	}
 
-	go http.ListenAndServe(":8000", nil)
+	server := &http.Server{Addr: cfg.HTTP.Addr}
+	// Event streams never end on their own, so close them when the server starts shutting down
+	server.RegisterOnShutdown(env.Events.Close)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP server stopped: %s\n", err.Error())
+		}
+	}()
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	log.Println("Running and ready")
-	<-stop
+	<-ctx.Done()
+	stop()
+
 	log.Println("Shutting down GPUBud...")
+	Shutdown(env, server)
+
+	return nil
+}
+
+// Stops accepting new work, gives in-flight requests, jobs and notifications until shutdownTimeout to
+// finish, persists any notifications that are still unsent and then closes the Discord session and
+// database.
+func Shutdown(env *Env, server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Could not shut down HTTP server cleanly: %s\n", err.Error())
+	}
+
+	err = env.UpdateManager.Shutdown(ctx)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	err = env.DiscordBot.Flush(ctx)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	err = env.DiscordBot.Close()
+	if err != nil {
+		log.Printf("Could not close discord session: %s\n", err.Error())
+	}
+
+	db, err := env.DB.DB()
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		log.Printf("Could not close database: %s\n", err.Error())
+	}
+
+	log.Println("Shutdown complete")
 }
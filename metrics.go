@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The retailer label used for metrics about the Microcenter scraper
+const retailerMicrocenter = "microcenter"
+
+// Prometheus metrics exported on /metrics
+var (
+	scrapeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gpubud_scrape_duration_seconds",
+		Help:    "Time taken to scrape and store a retailer's listings.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"retailer", "outcome"})
+
+	scrapesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gpubud_scrapes_total",
+		Help: "Number of scrapes attempted, by retailer and outcome.",
+	}, []string{"retailer", "outcome"})
+
+	scrapeGPUsParsed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gpubud_scrape_gpus_parsed",
+		Help: "Number of GPU listings parsed by the most recent successful scrape.",
+	}, []string{"retailer"})
+
+	lastScrapeSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gpubud_last_scrape_success_timestamp_seconds",
+		Help: "Unix time of the most recent successful scrape.",
+	}, []string{"retailer"})
+
+	gpusInStock = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gpubud_gpus_in_stock",
+		Help: "Number of tracked GPUs that currently have stock.",
+	})
+
+	gpuPrice = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gpubud_gpu_price_dollars",
+		Help: "Current price of each tracked GPU.",
+	}, []string{"id", "sku", "manufacturer", "brand", "line", "model"})
+
+	gpuStock = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gpubud_gpu_stock",
+		Help: "Current stock of each tracked GPU.",
+	}, []string{"id", "sku", "manufacturer", "brand", "line", "model"})
+
+	notificationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gpubud_notifications_total",
+		Help: "Number of notifications sent, by notifier and result.",
+	}, []string{"notifier", "result"})
+
+	updateCallbackDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gpubud_update_callback_duration_seconds",
+		Help:    "Time taken by each UpdateManager callback, by callback and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"callback", "outcome"})
+
+	discordInteractionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gpubud_discord_interaction_duration_seconds",
+		Help:    "Time taken to handle a Discord interaction, by interaction type and name.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 3, 5},
+	}, []string{"type", "name"})
+)
+
+// Returns "success" or "error" for use as an outcome label
+func outcomeLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
+
+// Records the duration and outcome of a scrape
+func ObserveScrape(retailer string, start time.Time, parsed int, err error) {
+	outcome := outcomeLabel(err)
+	scrapeDuration.WithLabelValues(retailer, outcome).Observe(time.Since(start).Seconds())
+	scrapesTotal.WithLabelValues(retailer, outcome).Inc()
+
+	if err == nil {
+		scrapeGPUsParsed.WithLabelValues(retailer).Set(float64(parsed))
+		lastScrapeSuccess.WithLabelValues(retailer).SetToCurrentTime()
+	}
+}
+
+// Records whether a notification was delivered
+func ObserveNotification(notifier string, err error) {
+	result := "sent"
+	if err != nil {
+		result = "failed"
+	}
+
+	notificationsTotal.WithLabelValues(notifier, result).Inc()
+}
+
+// Replaces the per GPU price and stock gauges with the current contents of the database
+func RecordGPUMetrics(gpus []*GPU) {
+	gpuPrice.Reset()
+	gpuStock.Reset()
+
+	inStock := 0
+	for _, gpu := range gpus {
+		labels := []string{strconv.Itoa(int(gpu.ID)), gpu.SKU, gpu.Manufacturer, gpu.Brand, gpu.Line, gpu.ProductModel}
+		gpuPrice.WithLabelValues(labels...).Set(gpu.Price)
+		gpuStock.WithLabelValues(labels...).Set(float64(gpu.Stock))
+
+		if gpu.Stock > 0 {
+			inStock++
+		}
+	}
+
+	gpusInStock.Set(float64(inStock))
+}
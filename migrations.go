@@ -0,0 +1,458 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// A versioned change to the database schema. Up and Down run inside a transaction, and must only use the
+// snapshot types declared alongside the migration, never the current models, so that a migration keeps
+// doing the same thing as the models change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// A row in the schema_migrations table, recording a migration that has been applied
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Every migration, in the order they are applied. Append new migrations to the end with the next version;
+// never edit or reorder a migration that has been released.
+var migrations = []*Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		// Databases created before versioned migrations were built by AutoMigrate from these same
+		// models, so this is a no-op for them and they are simply marked as version 1
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&gpuV1{}, &priceV1{}, &channelConfigV1{}, &channelConfigRuleV1{}, &userV1{}, &sessionV1{}, &apiTokenV1{}, &pendingNotificationV1{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&pendingNotificationV1{}, &apiTokenV1{}, &sessionV1{}, &userV1{}, &channelConfigRuleV1{}, &channelConfigV1{}, &priceV1{}, &gpuV1{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "price aggregates",
+		Up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&priceAggregateV2{})
+			if err != nil {
+				return err
+			}
+
+			// Finding a GPU's latest price happens on every scrape
+			return tx.Exec("CREATE INDEX IF NOT EXISTS idx_prices_gpu_time ON prices (gp_uid, time)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Exec("DROP INDEX IF EXISTS idx_prices_gpu_time").Error
+			if err != nil {
+				return err
+			}
+
+			return tx.Migrator().DropTable(&priceAggregateV2{})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "scrape runs",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&scrapeRunV3{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&scrapeRunV3{})
+		},
+	},
+	{
+		Version: 4,
+		Name:    "scrape run payloads",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&scrapeRunV4{})
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"PayloadJSON", "PayloadHTML", "Source"} {
+				err := tx.Migrator().DropColumn(&scrapeRunV4{}, column)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version: 5,
+		Name:    "rule filters",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&channelConfigRuleV5{})
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"Event", "Brand", "MaxPrice"} {
+				err := tx.Migrator().DropColumn(&channelConfigRuleV5{}, column)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+}
+
+// The schema version this build expects
+func LatestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+
+	return migrations[len(migrations)-1].Version
+}
+
+// Checks that migration versions start at 1 and increase by one, and that each can be rolled back
+func validateMigrations() error {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("migration %q has version %d, expected %d", m.Name, m.Version, i+1)
+		}
+		if m.Up == nil || m.Down == nil {
+			return fmt.Errorf("migration %d (%s) must have both Up and Down steps", m.Version, m.Name)
+		}
+	}
+
+	return nil
+}
+
+// Gets the version of the most recently applied migration, or 0 for a new database
+func SchemaVersion(DB *gorm.DB) (int, error) {
+	if !DB.Migrator().HasTable(&SchemaMigration{}) {
+		return 0, nil
+	}
+
+	var version int
+	result := DB.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version)
+	if result.Error != nil {
+		return 0, fmt.Errorf("could not read schema version: %s", result.Error)
+	}
+
+	return version, nil
+}
+
+// Returns an error if the database has been migrated by a newer build than this one. Running against a
+// newer schema could write rows that the newer build doesn't expect.
+func CheckSchemaVersion(DB *gorm.DB) error {
+	version, err := SchemaVersion(DB)
+	if err != nil {
+		return err
+	}
+
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("database schema is at version %d but this build only supports up to version %d, upgrade gpubud or roll the database back with an older build", version, LatestSchemaVersion())
+	}
+
+	return nil
+}
+
+// Applies or rolls back migrations until the database is at the target version. Each migration runs in
+// its own transaction along with the change to schema_migrations, so a failed migration leaves the
+// database at the last version that succeeded.
+func MigrateTo(DB *gorm.DB, target int) error {
+	err := validateMigrations()
+	if err != nil {
+		return err
+	}
+
+	if target < 0 || target > LatestSchemaVersion() {
+		return fmt.Errorf("cannot migrate to version %d, versions range from 0 to %d", target, LatestSchemaVersion())
+	}
+
+	err = CheckSchemaVersion(DB)
+	if err != nil {
+		return err
+	}
+
+	err = DB.AutoMigrate(&SchemaMigration{})
+	if err != nil {
+		return fmt.Errorf("could not create schema_migrations table: %s", err.Error())
+	}
+
+	version, err := SchemaVersion(DB)
+	if err != nil {
+		return err
+	}
+
+	for version < target {
+		m := migrations[version]
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			err := m.Up(tx)
+			if err != nil {
+				return err
+			}
+
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("could not apply migration %d (%s): %s", m.Version, m.Name, err.Error())
+		}
+
+		log.Printf("Applied migration %d (%s)\n", m.Version, m.Name)
+		version = m.Version
+	}
+
+	for version > target {
+		m := migrations[version-1]
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			err := m.Down(tx)
+			if err != nil {
+				return err
+			}
+
+			return tx.Delete(&SchemaMigration{}, "version = ?", m.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("could not roll back migration %d (%s): %s", m.Version, m.Name, err.Error())
+		}
+
+		log.Printf("Rolled back migration %d (%s)\n", m.Version, m.Name)
+		version = m.Version - 1
+	}
+
+	return nil
+}
+
+// Applies every migration that hasn't been applied yet
+func MigrateDatabase(DB *gorm.DB) error {
+	return MigrateTo(DB, LatestSchemaVersion())
+}
+
+// Lists every migration and whether it has been applied
+func MigrationStatus(DB *gorm.DB) ([]string, error) {
+	var applied []SchemaMigration
+	if DB.Migrator().HasTable(&SchemaMigration{}) {
+		result := DB.Order("version").Find(&applied)
+		if result.Error != nil {
+			return nil, fmt.Errorf("could not read schema_migrations: %s", result.Error)
+		}
+	}
+
+	var lines []string
+	for _, m := range migrations {
+		i := slices.IndexFunc(applied, func(a SchemaMigration) bool { return a.Version == m.Version })
+		if i < 0 {
+			lines = append(lines, fmt.Sprintf("%4d  pending                    %s", m.Version, m.Name))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%4d  applied %s  %s", m.Version, applied[i].AppliedAt.Format(time.RFC3339), m.Name))
+	}
+	for _, a := range applied {
+		if a.Version > LatestSchemaVersion() {
+			lines = append(lines, fmt.Sprintf("%4d  applied %s  %s (unknown to this build)", a.Version, a.AppliedAt.Format(time.RFC3339), a.Name))
+		}
+	}
+
+	return lines, nil
+}
+
+// Checks every migration against scratch in-memory databases: a database at each older version, and one
+// built by AutoMigrate before versioned migrations existed, must migrate up to the latest version, and
+// the latest version must roll all the way back down and up again.
+func VerifyMigrations() error {
+	open := func() (*gorm.DB, error) {
+		DB, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		if err != nil {
+			return nil, err
+		}
+
+		// Every connection to file::memory: gets its own database, so only ever use one
+		sqlDB, err := DB.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+
+		return DB, nil
+	}
+
+	for from := 0; from <= LatestSchemaVersion(); from++ {
+		DB, err := open()
+		if err != nil {
+			return fmt.Errorf("could not open scratch database: %s", err.Error())
+		}
+
+		err = MigrateTo(DB, from)
+		if err == nil {
+			err = MigrateDatabase(DB)
+		}
+		if err == nil {
+			err = MigrateTo(DB, 0)
+		}
+		if err == nil {
+			err = MigrateDatabase(DB)
+		}
+		if err != nil {
+			return fmt.Errorf("migrating from version %d: %s", from, err.Error())
+		}
+	}
+
+	DB, err := open()
+	if err != nil {
+		return fmt.Errorf("could not open scratch database: %s", err.Error())
+	}
+
+	err = migrations[0].Up(DB)
+	if err == nil {
+		err = MigrateDatabase(DB)
+	}
+	if err != nil {
+		return fmt.Errorf("migrating a database created before versioned migrations: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Snapshots of the models as they were at schema version 1
+
+type gpuV1 struct {
+	gorm.Model
+	ID           int32 `gorm:"primaryKey;autoIncrement:false"`
+	SKU          string
+	Brand        string
+	Line         string
+	Link         string
+	Manufacturer string
+	ProductModel string
+	Name         string
+	Stock        int32
+	Price        float64
+}
+
+func (gpuV1) TableName() string { return "gpus" }
+
+type priceV1 struct {
+	gorm.Model
+	Price float64
+	Stock int32
+	GPUID int32
+	GPU   *gpuV1
+	Time  time.Time
+}
+
+func (priceV1) TableName() string { return "prices" }
+
+type channelConfigV1 struct {
+	gorm.Model
+	ID         int32                  `gorm:"primaryKey"`
+	ChannelID  string                 `gorm:"unique;not null"`
+	Rules      []*channelConfigRuleV1 `gorm:"foreignKey:ChannelConfigRefer"`
+	Subscribed bool                   `gorm:"default:false"`
+}
+
+func (channelConfigV1) TableName() string { return "channel_configs" }
+
+type channelConfigRuleV1 struct {
+	gorm.Model
+	ID                 int32 `gorm:"primaryKey"`
+	ChannelConfigRefer uint
+	Query              string
+}
+
+func (channelConfigRuleV1) TableName() string { return "channel_config_rules" }
+
+type userV1 struct {
+	gorm.Model
+	Username     string `gorm:"unique;not null"`
+	PasswordHash string `gorm:"not null"`
+	IsAdmin      bool   `gorm:"default:false"`
+}
+
+func (userV1) TableName() string { return "users" }
+
+type sessionV1 struct {
+	gorm.Model
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	CSRFToken string `gorm:"not null"`
+	UserID    uint
+	User      *userV1
+	ExpiresAt time.Time
+}
+
+func (sessionV1) TableName() string { return "sessions" }
+
+type apiTokenV1 struct {
+	gorm.Model
+	Name       string `gorm:"not null"`
+	TokenHash  string `gorm:"uniqueIndex;not null"`
+	Scopes     string
+	UserID     uint
+	User       *userV1
+	LastUsedAt *time.Time
+}
+
+func (apiTokenV1) TableName() string { return "api_tokens" }
+
+type pendingNotificationV1 struct {
+	gorm.Model
+	ChannelID string `gorm:"not null"`
+	Payload   string `gorm:"not null"`
+}
+
+func (pendingNotificationV1) TableName() string { return "pending_notifications" }
+
+// Snapshots of the models added at schema version 2
+
+type priceAggregateV2 struct {
+	ID          uint      `gorm:"primaryKey"`
+	GPUID       int32     `gorm:"column:gpu_id;uniqueIndex:idx_price_aggregates_bucket"`
+	Resolution  string    `gorm:"uniqueIndex:idx_price_aggregates_bucket"`
+	BucketStart time.Time `gorm:"uniqueIndex:idx_price_aggregates_bucket"`
+	Min         float64
+	Max         float64
+	Close       float64
+	CloseStock  int32
+	Samples     int
+}
+
+func (priceAggregateV2) TableName() string { return "price_aggregates" }
+
+// Snapshots of the models added at schema version 3
+
+type scrapeRunV3 struct {
+	gorm.Model
+	Retailer   string
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Status     string
+	ItemCount  int
+	Changed    int
+	Error      string
+}
+
+func (scrapeRunV3) TableName() string { return "scrape_runs" }
+
+// Snapshots of the models changed at schema version 4
+
+type scrapeRunV4 struct {
+	scrapeRunV3
+	Source      string
+	PayloadHTML []byte
+	PayloadJSON []byte
+}
+
+// Snapshots of the models changed at schema version 5
+
+type channelConfigRuleV5 struct {
+	channelConfigRuleV1
+	MaxPrice float64
+	Brand    string
+	Event    string
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Opens an empty in-memory SQLite database that is closed when the test ends
+func openSQLiteTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	DB, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("could not open database: %s", err.Error())
+	}
+
+	// Every connection to file::memory: gets its own database, so only ever use one
+	sqlDB, err := DB.DB()
+	if err != nil {
+		t.Fatalf("could not open database: %s", err.Error())
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	return DB
+}
+
+// Migrates a new database to version and fills it with rows written through that version's snapshot types
+func seededDBAtVersion(t *testing.T, version int) *gorm.DB {
+	t.Helper()
+
+	DB := openSQLiteTestDB(t)
+	err := MigrateTo(DB, version)
+	if err != nil {
+		t.Fatalf("could not migrate to version %d: %s", version, err.Error())
+	}
+
+	create := func(value any) {
+		t.Helper()
+		result := DB.Create(value)
+		if result.Error != nil {
+			t.Fatalf("could not seed version %d database: %s", version, result.Error)
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	create(&gpuV1{ID: 7, SKU: "sku-7", Brand: "NVIDIA", Line: "GeForce RTX", ProductModel: "4070 Ti", Stock: 3, Price: 799.99})
+	create(&gpuV1{ID: 8, SKU: "sku-8", Brand: "AMD", Line: "Radeon RX", ProductModel: "7900 XTX", Stock: 0, Price: 949.99})
+	create(&priceV1{GPUID: 7, Price: 799.99, Stock: 3, Time: now})
+	create(&priceV1{GPUID: 8, Price: 949.99, Stock: 0, Time: now})
+	create(&channelConfigV1{ChannelID: "123", Subscribed: true, Rules: []*channelConfigRuleV1{{Query: "4070"}, {Query: "7900 XTX"}}})
+
+	if version >= 2 {
+		create(&priceAggregateV2{GPUID: 7, Resolution: ResolutionHour, BucketStart: now.Add(-48 * time.Hour), Min: 780, Max: 820, Close: 799.99, CloseStock: 3, Samples: 4})
+	}
+	if version == 3 {
+		create(&scrapeRunV3{Retailer: "microcenter", StartedAt: now, Status: ScrapeSucceeded, ItemCount: 2})
+	}
+	if version >= 4 {
+		create(&scrapeRunV4{scrapeRunV3: scrapeRunV3{Retailer: "microcenter", StartedAt: now, Status: ScrapeSucceeded, ItemCount: 2}, Source: "https://example.com", PayloadJSON: []byte("{}")})
+	}
+	if version >= 5 {
+		create(&channelConfigRuleV5{channelConfigRuleV1: channelConfigRuleV1{ChannelConfigRefer: 1, Query: "Arc"}, Brand: "Intel", Event: RuleEventRestock})
+	}
+
+	return DB
+}
+
+// Checks the GPUs, prices and rules written by seededDBAtVersion are all still there
+func checkSeededRows(t *testing.T, DB *gorm.DB, rules int) {
+	t.Helper()
+
+	count := func(table string) int64 {
+		t.Helper()
+		var n int64
+		result := DB.Table(table).Where("deleted_at IS NULL").Count(&n)
+		if result.Error != nil {
+			t.Fatalf("could not count %s: %s", table, result.Error)
+		}
+		return n
+	}
+
+	if n := count("gpus"); n != 2 {
+		t.Errorf("got %d GPUs, want 2", n)
+	}
+	if n := count("prices"); n != 2 {
+		t.Errorf("got %d prices, want 2", n)
+	}
+	if n := count("channel_config_rules"); n != int64(rules) {
+		t.Errorf("got %d rules, want %d", n, rules)
+	}
+
+	var model string
+	DB.Table("gpus").Where("id = ?", 7).Select("product_model").Scan(&model)
+	if model != "4070 Ti" {
+		t.Errorf("got model %q for GPU 7, want %q", model, "4070 Ti")
+	}
+}
+
+func TestMigrateUpKeepsData(t *testing.T) {
+	for from := 1; from < LatestSchemaVersion(); from++ {
+		DB := seededDBAtVersion(t, from)
+
+		err := MigrateDatabase(DB)
+		if err != nil {
+			t.Fatalf("could not migrate from version %d: %s", from, err.Error())
+		}
+
+		version, err := SchemaVersion(DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != LatestSchemaVersion() {
+			t.Errorf("from version %d: got version %d, want %d", from, version, LatestSchemaVersion())
+		}
+
+		checkSeededRows(t, DB, 2)
+
+		// The current models must be able to read what the older schema wrote
+		configs, err := LoadChannelConfigs(&Env{DB: DB})
+		if err != nil {
+			t.Fatalf("from version %d: %s", from, err.Error())
+		}
+		if len(configs) != 1 || !configs[0].Subscribed || len(configs[0].Rules) != 2 {
+			t.Fatalf("from version %d: got channel configs %+v, want one subscribed config with 2 rules", from, configs)
+		}
+		for _, rule := range configs[0].Rules {
+			if rule.MaxPrice != 0 || rule.Brand != "" {
+				t.Errorf("from version %d: rule %q got filters %q, want none", from, rule.Query, rule.Filters())
+			}
+		}
+
+		var gpu GPU
+		result := DB.First(&gpu, 8)
+		if result.Error != nil {
+			t.Fatalf("from version %d: %s", from, result.Error)
+		}
+		if gpu.Brand != "AMD" || gpu.Price != 949.99 {
+			t.Errorf("from version %d: got GPU %+v", from, gpu)
+		}
+
+		if from >= 2 {
+			var aggregates []*PriceAggregate
+			DB.Find(&aggregates)
+			if len(aggregates) != 1 || aggregates[0].Close != 799.99 {
+				t.Errorf("from version %d: got aggregates %+v, want the seeded one", from, aggregates)
+			}
+		}
+	}
+}
+
+func TestMigrateDownEachStep(t *testing.T) {
+	tests := []struct {
+		version int
+		// A table and column that must be gone after rolling back the version, or just a table
+		table  string
+		column string
+	}{
+		{5, "channel_config_rules", "brand"},
+		{4, "scrape_runs", "payload_json"},
+		{3, "scrape_runs", ""},
+		{2, "price_aggregates", ""},
+		{1, "gpus", ""},
+	}
+
+	for _, test := range tests {
+		DB := seededDBAtVersion(t, test.version)
+
+		err := MigrateTo(DB, test.version-1)
+		if err != nil {
+			t.Fatalf("could not roll back version %d: %s", test.version, err.Error())
+		}
+
+		migrator := DB.Migrator()
+		if test.column != "" {
+			if migrator.HasColumn(test.table, test.column) {
+				t.Errorf("rolling back version %d left %s.%s", test.version, test.table, test.column)
+			}
+		} else if migrator.HasTable(test.table) {
+			t.Errorf("rolling back version %d left table %s", test.version, test.table)
+		}
+
+		// Rows in tables the rollback keeps must survive it
+		if test.version > 1 {
+			rules := 2
+			if test.version >= 5 {
+				rules = 3
+			}
+			checkSeededRows(t, DB, rules)
+		}
+		if test.version == 4 {
+			var n int64
+			DB.Table("scrape_runs").Count(&n)
+			if n != 1 {
+				t.Errorf("rolling back version 4 left %d scrape runs, want 1", n)
+			}
+		}
+
+		// And the version must apply again afterwards
+		err = MigrateDatabase(DB)
+		if err != nil {
+			t.Fatalf("could not reapply version %d: %s", test.version, err.Error())
+		}
+	}
+}
+
+func TestNewerSchemaVersionIsRefused(t *testing.T) {
+	dir := t.TempDir()
+	newer := filepath.Join(dir, "newer.db")
+
+	DB, err := gorm.Open(sqlite.Open(newer), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("could not open database: %s", err.Error())
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		t.Fatalf("could not open database: %s", err.Error())
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	err = MigrateDatabase(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As if a newer build had applied a migration this one doesn't know about
+	result := DB.Create(&SchemaMigration{Version: LatestSchemaVersion() + 1, Name: "from the future", AppliedAt: time.Now()})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	if err := CheckSchemaVersion(DB); err == nil {
+		t.Error("CheckSchemaVersion accepted a newer schema")
+	}
+	if err := MigrateDatabase(DB); err == nil {
+		t.Error("MigrateDatabase ran against a newer schema")
+	}
+	if version, _ := SchemaVersion(DB); version != LatestSchemaVersion()+1 {
+		t.Errorf("got schema version %d after refusing, want %d", version, LatestSchemaVersion()+1)
+	}
+
+	// Restoring the newer database as a backup must leave the current one in place
+	current := filepath.Join(dir, "gpubud.db")
+	err = os.WriteFile(current, []byte("current database"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := RestoreDatabase(newer, current)
+	if err == nil {
+		t.Fatal("RestoreDatabase restored a newer schema")
+	}
+	if previous != "" {
+		t.Errorf("RestoreDatabase moved the current database aside to %s", previous)
+	}
+	if data, _ := os.ReadFile(current); string(data) != "current database" {
+		t.Error("RestoreDatabase replaced the current database")
+	}
+}
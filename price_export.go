@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"gorm.io/gorm"
+)
+
+// Formats price history can be exported in
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// Rows are written to Parquet files in row groups of this many rows, which bounds how much is buffered
+const parquetRowGroupSize = 10000
+
+// Resolution of exported prices that haven't been rolled up into aggregates
+const ResolutionRaw = "raw"
+
+// One recorded price or price aggregate along with the GPU it belongs to. For an aggregate, Time is the
+// start of its bucket, Price and Stock are the last ones recorded in the bucket and Min and Max span the
+// bucket. For a raw price Min and Max are the price.
+type PriceRow struct {
+	Time         time.Time `parquet:"time,timestamp(millisecond)" gorm:"column:time"`
+	GPUID        int32     `parquet:"gpu_id" gorm:"column:gpu_id"`
+	SKU          string    `parquet:"sku" gorm:"column:sku"`
+	Manufacturer string    `parquet:"manufacturer" gorm:"column:manufacturer"`
+	Brand        string    `parquet:"brand" gorm:"column:brand"`
+	Line         string    `parquet:"line" gorm:"column:line"`
+	Model        string    `parquet:"model" gorm:"column:model"`
+	Name         string    `parquet:"name" gorm:"column:name"`
+	Price        float64   `parquet:"price" gorm:"column:price"`
+	Stock        int32     `parquet:"stock" gorm:"column:stock"`
+	// raw, hour or day
+	Resolution string  `parquet:"resolution" gorm:"column:resolution"`
+	Min        float64 `parquet:"min" gorm:"column:min"`
+	Max        float64 `parquet:"max" gorm:"column:max"`
+}
+
+var priceRowHeader = []string{"time", "gpu_id", "sku", "manufacturer", "brand", "line", "model", "name", "price", "stock", "resolution", "min", "max"}
+
+func (row *PriceRow) csvRecord() []string {
+	return []string{
+		row.Time.UTC().Format(time.RFC3339),
+		strconv.Itoa(int(row.GPUID)),
+		row.SKU,
+		row.Manufacturer,
+		row.Brand,
+		strings.TrimSpace(row.Line),
+		row.Model,
+		row.Name,
+		strconv.FormatFloat(row.Price, 'f', 2, 64),
+		strconv.Itoa(int(row.Stock)),
+		row.Resolution,
+		strconv.FormatFloat(row.Min, 'f', 2, 64),
+		strconv.FormatFloat(row.Max, 'f', 2, 64),
+	}
+}
+
+// Which prices to export. Zero values don't filter.
+type PriceExportFilter struct {
+	Since time.Time
+	Until time.Time
+	// Matches the GPU brand exactly, ignoring case
+	Brand string
+	// Matches GPUs whose model contains this, ignoring case
+	Model string
+}
+
+// Parses a time given as either a date (2006-01-02) or an RFC 3339 timestamp
+func parseExportTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, use YYYY-MM-DD or RFC 3339", s)
+	}
+
+	return t, nil
+}
+
+// Builds a filter from since, until, brand and model values, as given in query parameters or flags
+func NewPriceExportFilter(since, until, brand, model string) (*PriceExportFilter, error) {
+	filter := &PriceExportFilter{Brand: brand, Model: model}
+
+	var err error
+	if since != "" {
+		filter.Since, err = parseExportTime(since)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if until != "" {
+		filter.Until, err = parseExportTime(until)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return filter, nil
+}
+
+// Streams the recorded prices matching filter to w as CSV or Parquet, oldest first. Prices the retention job
+// has rolled up are exported from their hourly and daily aggregates, marked by the resolution column. Rows
+// are read from the database one at a time, so the whole history is never held in memory, and reading stops
+// if ctx is cancelled. Returns the number of rows written.
+func ExportPrices(ctx context.Context, env *Env, w io.Writer, format string, filter *PriceExportFilter) (int, error) {
+	db := env.DB.WithContext(ctx)
+	const gpuColumns = "gpus.id AS gpu_id, gpus.sku, gpus.manufacturer, gpus.brand, gpus.line, gpus.product_model AS model, gpus.name"
+
+	applyFilter := func(query *gorm.DB, timeColumn string) *gorm.DB {
+		if !filter.Since.IsZero() {
+			query = query.Where(timeColumn+" >= ?", filter.Since)
+		}
+		if !filter.Until.IsZero() {
+			query = query.Where(timeColumn+" < ?", filter.Until)
+		}
+		if filter.Brand != "" {
+			query = query.Where("LOWER(gpus.brand) = ?", strings.ToLower(filter.Brand))
+		}
+		if filter.Model != "" {
+			query = query.Where(`LOWER(gpus.product_model) LIKE ? ESCAPE '\'`, "%"+escapeLike(strings.ToLower(filter.Model))+"%")
+		}
+		return query
+	}
+
+	raw := applyFilter(db.Table("prices").
+		Select("prices.time AS time, "+gpuColumns+", prices.price, prices.stock, '"+ResolutionRaw+"' AS resolution, prices.price AS min, prices.price AS max").
+		Joins("JOIN gpus ON gpus.id = prices.gp_uid").
+		Where("prices.deleted_at IS NULL"), "prices.time")
+	aggregated := applyFilter(db.Table("price_aggregates").
+		Select("price_aggregates.bucket_start AS time, "+gpuColumns+", price_aggregates.close AS price, price_aggregates.close_stock AS stock, price_aggregates.resolution, price_aggregates.min, price_aggregates.max").
+		Joins("JOIN gpus ON gpus.id = price_aggregates.gpu_id"), "price_aggregates.bucket_start")
+
+	rows, err := db.Raw("? UNION ALL ? ORDER BY time, gpu_id", raw, aggregated).Rows()
+	if err != nil {
+		return 0, fmt.Errorf("could not export prices: %s", err.Error())
+	}
+	defer rows.Close()
+
+	var write func(row *PriceRow) error
+	var finish func() error
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		err = cw.Write(priceRowHeader)
+		if err != nil {
+			return 0, fmt.Errorf("could not export prices: %s", err.Error())
+		}
+		write = func(row *PriceRow) error {
+			return cw.Write(row.csvRecord())
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case FormatParquet:
+		pw := parquet.NewGenericWriter[PriceRow](w, parquet.MaxRowsPerRowGroup(parquetRowGroupSize))
+		write = func(row *PriceRow) error {
+			_, err := pw.Write([]PriceRow{*row})
+			return err
+		}
+		finish = pw.Close
+	default:
+		return 0, fmt.Errorf("unknown export format %q, use %s or %s", format, FormatCSV, FormatParquet)
+	}
+
+	count := 0
+	for rows.Next() {
+		var row PriceRow
+		err := env.DB.ScanRows(rows, &row)
+		if err != nil {
+			return count, fmt.Errorf("could not export prices: %s", err.Error())
+		}
+
+		err = write(&row)
+		if err != nil {
+			return count, fmt.Errorf("could not export prices: %s", err.Error())
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("could not export prices: %s", err.Error())
+	}
+
+	err = finish()
+	if err != nil {
+		return count, fmt.Errorf("could not export prices: %s", err.Error())
+	}
+
+	return count, nil
+}
+
+// Streams price history as a CSV or Parquet download. Takes the query parameters format (csv or parquet),
+// since and until (YYYY-MM-DD or RFC 3339), brand and model.
+func HandleAPIPriceExport(env *Env) func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		format := query.Get("format")
+		if format == "" {
+			format = FormatCSV
+		}
+
+		contentType := ""
+		switch format {
+		case FormatCSV:
+			contentType = "text/csv; charset=utf-8"
+		case FormatParquet:
+			contentType = "application/vnd.apache.parquet"
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q, use %s or %s", format, FormatCSV, FormatParquet), http.StatusBadRequest)
+			return
+		}
+
+		filter, err := NewPriceExportFilter(query.Get("since"), query.Get("until"), query.Get("brand"), query.Get("model"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gpubud-prices.%s"`, format))
+
+		// Headers are already sent once rows start streaming, so a failure part way through can only be logged
+		_, err = ExportPrices(r.Context(), env, w, format, filter)
+		if err != nil {
+			log.Println("error in route api/prices/export: ", err.Error())
+		}
+	}
+
+	return handler
+}
+
+// Writes price history joined with GPU details as CSV or Parquet
+//
+//	gpubud export-prices [-format csv|parquet] [-o file] [-since date] [-until date] [-brand brand] [-model model]
+func RunExportPrices(args []string) error {
+	fs := flag.NewFlagSet("export-prices", flag.ExitOnError)
+	format := fs.String("format", FormatCSV, "export format, csv or parquet")
+	output := fs.String("o", "", "file to write the export to (default stdout)")
+	since := fs.String("since", "", "only export prices recorded at or after this time (YYYY-MM-DD or RFC 3339)")
+	until := fs.String("until", "", "only export prices recorded before this time (YYYY-MM-DD or RFC 3339)")
+	brand := fs.String("brand", "", "only export GPUs of this brand")
+	model := fs.String("model", "", "only export GPUs whose model contains this")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	filter, err := NewPriceExportFilter(*since, *until, *brand, *model)
+	if err != nil {
+		return err
+	}
+
+	env, err := InitCLIEnvironment(cfg)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("could not create export file: %s", err.Error())
+		}
+		defer f.Close()
+		w = f
+	}
+
+	count, err := ExportPrices(context.Background(), env, w, *format, filter)
+	if err != nil {
+		return err
+	}
+
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "Exported %d prices to %s\n", count, *output)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How many price rows are deleted per statement when compacting
+const compactBatchSize = 500
+
+// Rolls old prices up into aggregates according to the retention config. Prices older than retention.raw
+// become hourly aggregates, hourly aggregates older than retention.hourly become daily aggregates, and
+// daily aggregates older than retention.daily are deleted. Only whole hours and days are rolled up, so a
+// bucket is never split between raw prices and an aggregate.
+func ApplyPriceRetention(ctx context.Context, env *Env) error {
+	retention := env.Config.Retention
+	now := time.Now().UTC()
+
+	rawCutoff := now.Add(-time.Duration(retention.Raw)).Truncate(time.Hour)
+	rolled, err := rollUpPrices(ctx, env, rawCutoff)
+	if err != nil {
+		return fmt.Errorf("error in applying price retention: %s", err.Error())
+	}
+
+	hourlyCutoff := now.Add(-time.Duration(retention.Hourly)).Truncate(24 * time.Hour)
+	rolledHours, err := rollUpHours(ctx, env, hourlyCutoff)
+	if err != nil {
+		return fmt.Errorf("error in applying price retention: %s", err.Error())
+	}
+
+	var deleted int64
+	if retention.Daily > 0 {
+		result := env.DB.WithContext(ctx).Where("resolution = ? AND bucket_start < ?", ResolutionDay, now.Add(-time.Duration(retention.Daily))).Delete(&PriceAggregate{})
+		if result.Error != nil {
+			return fmt.Errorf("error in applying price retention: %s", result.Error)
+		}
+		deleted = result.RowsAffected
+	}
+
+	if rolled > 0 || rolledHours > 0 || deleted > 0 {
+		log.Printf("Price retention: rolled %d prices into hourly aggregates, %d hourly aggregates into daily aggregates and deleted %d daily aggregates\n", rolled, rolledHours, deleted)
+	}
+
+	return nil
+}
+
+// Adds a price or aggregate to the aggregate for its bucket
+func accumulate(buckets map[time.Time]*PriceAggregate, order *[]time.Time, gpuID int32, resolution string, start time.Time, point *PriceAggregate) {
+	agg, ok := buckets[start]
+	if !ok {
+		agg = &PriceAggregate{GPUID: gpuID, Resolution: resolution, BucketStart: start, Min: point.Min, Max: point.Max}
+		buckets[start] = agg
+		*order = append(*order, start)
+	}
+
+	agg.Min = min(agg.Min, point.Min)
+	agg.Max = max(agg.Max, point.Max)
+	// Points are added oldest first, so the latest one closes the bucket
+	agg.Close = point.Close
+	agg.CloseStock = point.CloseStock
+	agg.Samples += point.Samples
+}
+
+// Saves an aggregate, merging it into an existing aggregate for the same bucket. Buckets only get a
+// second aggregate when the retention config is shortened, and the new data is always the later part.
+func saveAggregate(tx *gorm.DB, agg *PriceAggregate) error {
+	var existing []*PriceAggregate
+	result := tx.Where("gpu_id = ? AND resolution = ? AND bucket_start = ?", agg.GPUID, agg.Resolution, agg.BucketStart).Limit(1).Find(&existing)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if len(existing) > 0 {
+		old := existing[0]
+		agg.ID = old.ID
+		agg.Min = min(agg.Min, old.Min)
+		agg.Max = max(agg.Max, old.Max)
+		agg.Samples += old.Samples
+	}
+
+	return tx.Save(agg).Error
+}
+
+// Rolls every price older than cutoff into hourly aggregates and deletes the prices. Each GPU is rolled up
+// in its own transaction.
+func rollUpPrices(ctx context.Context, env *Env, cutoff time.Time) (int, error) {
+	var gpuIDs []int32
+	result := env.DB.WithContext(ctx).Model(&Price{}).Where("time < ?", cutoff).Distinct().Pluck("gp_uid", &gpuIDs)
+	if result.Error != nil {
+		return 0, fmt.Errorf("could not find prices to roll up: %s", result.Error)
+	}
+
+	rolled := 0
+	for _, id := range gpuIDs {
+		err := env.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			var prices []*Price
+			result := tx.Where("gp_uid = ? AND time < ?", id, cutoff).Order("time").Find(&prices)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			buckets := make(map[time.Time]*PriceAggregate)
+			var order []time.Time
+			for _, p := range prices {
+				start := p.Time.UTC().Truncate(time.Hour)
+				accumulate(buckets, &order, id, ResolutionHour, start, &PriceAggregate{Min: p.Price, Max: p.Price, Close: p.Price, CloseStock: p.Stock, Samples: 1})
+			}
+
+			for _, start := range order {
+				err := saveAggregate(tx, buckets[start])
+				if err != nil {
+					return err
+				}
+			}
+
+			result = tx.Unscoped().Where("gp_uid = ? AND time < ?", id, cutoff).Delete(&Price{})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			rolled += len(prices)
+			return nil
+		})
+		if err != nil {
+			return rolled, fmt.Errorf("could not roll up prices for GPU %d: %s", id, err.Error())
+		}
+	}
+
+	return rolled, nil
+}
+
+// Rolls every hourly aggregate older than cutoff into daily aggregates and deletes the hourly aggregates
+func rollUpHours(ctx context.Context, env *Env, cutoff time.Time) (int, error) {
+	var gpuIDs []int32
+	result := env.DB.WithContext(ctx).Model(&PriceAggregate{}).Where("resolution = ? AND bucket_start < ?", ResolutionHour, cutoff).Distinct().Pluck("gpu_id", &gpuIDs)
+	if result.Error != nil {
+		return 0, fmt.Errorf("could not find hourly aggregates to roll up: %s", result.Error)
+	}
+
+	rolled := 0
+	for _, id := range gpuIDs {
+		err := env.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			var hours []*PriceAggregate
+			result := tx.Where("gpu_id = ? AND resolution = ? AND bucket_start < ?", id, ResolutionHour, cutoff).Order("bucket_start").Find(&hours)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			buckets := make(map[time.Time]*PriceAggregate)
+			var order []time.Time
+			for _, h := range hours {
+				start := h.BucketStart.UTC().Truncate(24 * time.Hour)
+				accumulate(buckets, &order, id, ResolutionDay, start, h)
+			}
+
+			for _, start := range order {
+				err := saveAggregate(tx, buckets[start])
+				if err != nil {
+					return err
+				}
+			}
+
+			result = tx.Where("gpu_id = ? AND resolution = ? AND bucket_start < ?", id, ResolutionHour, cutoff).Delete(&PriceAggregate{})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			rolled += len(hours)
+			return nil
+		})
+		if err != nil {
+			return rolled, fmt.Errorf("could not roll up hourly aggregates for GPU %d: %s", id, err.Error())
+		}
+	}
+
+	return rolled, nil
+}
+
+// Deletes recorded prices that repeat the previous price and stock of the same GPU, keeping one every
+// heartbeat. This brings databases written before change-only storage in line with what CreatePrice
+// records now. With dryRun set nothing is deleted. Returns the number of prices deleted, or that would be.
+func CompactPrices(ctx context.Context, env *Env, heartbeat time.Duration, dryRun bool) (int, error) {
+	var gpuIDs []int32
+	result := env.DB.WithContext(ctx).Model(&Price{}).Distinct().Pluck("gp_uid", &gpuIDs)
+	if result.Error != nil {
+		return 0, fmt.Errorf("could not find prices to compact: %s", result.Error)
+	}
+
+	removed := 0
+	for _, id := range gpuIDs {
+		var prices []*Price
+		result := env.DB.WithContext(ctx).Select("id", "price", "stock", "time").Where("gp_uid = ?", id).Order("time").Find(&prices)
+		if result.Error != nil {
+			return removed, fmt.Errorf("could not load prices for GPU %d: %s", id, result.Error)
+		}
+
+		var redundant []uint
+		var kept *Price
+		for _, p := range prices {
+			if kept != nil && p.Price == kept.Price && p.Stock == kept.Stock && p.Time.Sub(kept.Time) < heartbeat {
+				redundant = append(redundant, p.ID)
+				continue
+			}
+			kept = p
+		}
+
+		removed += len(redundant)
+		if dryRun {
+			continue
+		}
+
+		for start := 0; start < len(redundant); start += compactBatchSize {
+			batch := redundant[start:min(start+compactBatchSize, len(redundant))]
+			result := env.DB.WithContext(ctx).Unscoped().Delete(&Price{}, batch)
+			if result.Error != nil {
+				return removed, fmt.Errorf("could not compact prices for GPU %d: %s", id, result.Error)
+			}
+		}
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Decides when an UpdateManager job runs next
+type Schedule interface {
+	// Returns the next time the job should run after t
+	Next(t time.Time) time.Time
+	// Describes the schedule for status output
+	String() string
+}
+
+// Runs a job at a fixed interval
+type IntervalSchedule struct {
+	Interval time.Duration
+}
+
+func (s *IntervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.Interval)
+}
+
+func (s *IntervalSchedule) String() string {
+	return fmt.Sprintf("every %s", s.Interval)
+}
+
+// Creates a schedule that runs a job every d
+func Every(d time.Duration) *IntervalSchedule {
+	return &IntervalSchedule{Interval: d}
+}
+
+// Runs a job according to a cron expression, evaluated in a specific time zone
+type CronSchedule struct {
+	expr     string
+	schedule cron.Schedule
+	location *time.Location
+}
+
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	return s.schedule.Next(t.In(s.location))
+}
+
+func (s *CronSchedule) String() string {
+	return fmt.Sprintf("cron %q (%s)", s.expr, s.location)
+}
+
+// The parser for cron expressions. Accepts the standard five fields (minute, hour, day of month, month,
+// day of week) as well as descriptors such as @hourly and @every 10m.
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Parses a cron expression whose times are interpreted in loc. A nil loc means the local time zone.
+// An expression may also name its own zone with a CRON_TZ= prefix, which takes precedence over loc.
+func ParseCron(expr string, loc *time.Location) (*CronSchedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	schedule, err := cronParser.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %s", expr, err.Error())
+	}
+
+	if spec, ok := schedule.(*cron.SpecSchedule); ok {
+		if spec.Location == time.Local {
+			spec.Location = loc
+		} else {
+			loc = spec.Location
+		}
+	}
+
+	return &CronSchedule{
+		expr:     expr,
+		schedule: schedule,
+		location: loc,
+	}, nil
+}
+
+// Gets the shortest and longest time between the next n runs of a schedule after t. Cron schedules
+// don't run at a fixed interval, so this is how often they run in practice. Both are zero if the
+// schedule never runs again.
+func scheduleGaps(s Schedule, t time.Time, n int) (shortest, longest time.Duration) {
+	prev := s.Next(t)
+	for range n {
+		next := s.Next(prev)
+		if prev.IsZero() || next.IsZero() {
+			break
+		}
+		gap := next.Sub(prev)
+		if shortest == 0 || gap < shortest {
+			shortest = gap
+		}
+		longest = max(longest, gap)
+		prev = next
+	}
+
+	return shortest, longest
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"time"
 
@@ -26,42 +28,163 @@ func (diff *GPUDifference) String() string {
 	return fmt.Sprintf("%v (%v/%v)", diff.GPUID, diff.PriceNew-diff.PriceOld, diff.StockNew-diff.StockOld)
 }
 
-// Scrapes the Microcenter website for GPU data
-func Scrape(env *Env) error {
+// Scrapes the Microcenter website for GPU data. The results are saved in a single transaction, and
+// live updates and notifications are only sent once it commits. Every scrape is recorded as a ScrapeRun.
+func Scrape(ctx context.Context, env *Env) (err error) {
 	log.Println("Attempting to update GPU list from scraper")
 
-	var data ScrapeData
+	start := time.Now()
+	run := &ScrapeRun{Retailer: retailerMicrocenter, Source: env.Config.Scraper.MicrocenterURL, StartedAt: start, Status: ScrapeRunning}
+	result := env.DB.Create(run)
+	if result.Error != nil {
+		return fmt.Errorf("error in scraping microcenter: could not record scrape run: %s", result.Error)
+	}
+
+	var payload *ScrapePayload
+	defer func() {
+		ObserveScrape(retailerMicrocenter, start, run.ItemCount, err)
+		finishScrapeRun(env, run, payload, err)
+	}()
+
+	data, payload, err := RunMicrocenterScraper(ctx, env.Config.Scraper.MicrocenterURL)
+	if err != nil {
+		return err
+	}
+	run.ItemCount = len(data.GPUs)
+
+	diffs, err := ApplyScrape(ctx, env, data)
+	if err != nil {
+		return fmt.Errorf("error in scraping microcenter: %s", err.Error())
+	}
+
+	for _, diff := range diffs {
+		if diff.IsDiff {
+			run.Changed++
+		}
+		env.Events.Publish(diff)
+	}
+
+	// There is no bot when scraping from the command line
+	if env.DiscordBot != nil {
+		env.DiscordBot.Dispatch(diffs)
+	}
+
+	gpus, err := GetAllGPUs(env)
+	if err != nil {
+		return fmt.Errorf("error in scraping microcenter: %s", err.Error())
+	}
+	RecordGPUMetrics(gpus)
+
+	env.SetLastScrapeTime(time.Now())
+
+	return nil
+}
+
+// Saves scraped GPUs, their prices and the GPUs that are no longer listed in one transaction, returning
+// how each GPU changed. Nothing is saved if any part fails.
+func ApplyScrape(ctx context.Context, env *Env, data *ScrapeData) ([]*GPUDifference, error) {
+	var diffs []*GPUDifference
+	err := env.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		txEnv := &Env{DB: tx, Config: env.Config}
+
+		for _, gpu := range data.GPUs {
+			diff, err := Difference(gpu, txEnv)
+			if err != nil {
+				return err
+			}
+			diffs = append(diffs, diff)
+
+			err = InsertGPU(txEnv, gpu)
+			if err != nil {
+				return err
+			}
+		}
+
+		return UpdateMissingGPUs(txEnv, data.GPUs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return diffs, nil
+}
+
+// Records the outcome of a scrape run, archiving its payload unless archiving is turned off
+func finishScrapeRun(env *Env, run *ScrapeRun, payload *ScrapePayload, err error) {
+	now := time.Now()
+	run.FinishedAt = &now
+	run.Status = ScrapeSucceeded
+	if err != nil {
+		run.Status = ScrapeFailed
+		run.Error = err.Error()
+	}
+
+	if payload != nil && env.Config.Retention.Archive > 0 {
+		archiveErr := run.SetPayload(payload)
+		if archiveErr != nil {
+			log.Printf("Could not archive payload of scrape run %d: %s\n", run.ID, archiveErr.Error())
+		}
+	}
+
+	result := env.DB.Save(run)
+	if result.Error != nil {
+		log.Printf("Could not record scrape run %d: %s\n", run.ID, result.Error)
+	}
+}
+
+// Runs the Python scraper against a Microcenter search page and parses its output. The fetched page and
+// the scraper's output are returned even when parsing fails, so they can be archived.
+func RunMicrocenterScraper(ctx context.Context, url string) (*ScrapeData, *ScrapePayload, error) {
+	payload := &ScrapePayload{}
+
+	htmlFile, err := os.CreateTemp("", "gpubud-scrape-*.html")
+	if err != nil {
+		return nil, payload, fmt.Errorf("error in scraping microcenter: %s", err.Error())
+	}
+	htmlFile.Close()
+	defer os.Remove(htmlFile.Name())
 
 	// execute the python scraper and get the data back
-	cmd := exec.Command("python3", "./scrapers/scrape_microcenter.py", "-s", env.MicrocenterUrl)
+	cmd := exec.CommandContext(ctx, "python3", "./scrapers/scrape_microcenter.py", "-s", url, "--html-out", htmlFile.Name())
 	out, command_err := cmd.CombinedOutput()
+	payload.Output = out
+	payload.HTML, _ = os.ReadFile(htmlFile.Name())
 	if command_err != nil {
-		return fmt.Errorf("error in scraping microcenter: %s", command_err.Error())
+		return nil, payload, fmt.Errorf("error in scraping microcenter: %s", command_err.Error())
 	}
 
-	// unpack the data from json format into a ScrapeData struct
-	convert_err := json.Unmarshal(out, &data)
-	if convert_err != nil {
-		return fmt.Errorf("error in scraping microcenter: %s", convert_err.Error())
+	data, err := parseScraperOutput(out)
+	if err != nil {
+		return nil, payload, err
 	}
 
-	var diffs []*GPUDifference
-	for _, gpu := range data.GPUs {
-		diff, err := Difference(gpu, env)
-		if err != nil {
-			return fmt.Errorf("error in scraping microcenter: %s", err.Error())
-		}
+	return data, payload, nil
+}
 
-		diffs = append(diffs, diff)
-		InsertGPU(env, gpu)
+// Unpacks the scraper's JSON output
+func parseScraperOutput(out []byte) (*ScrapeData, error) {
+	// unpack the data from json format into a ScrapeData struct
+	var data ScrapeData
+	convert_err := json.Unmarshal(out, &data)
+	if convert_err != nil {
+		return nil, fmt.Errorf("error in scraping microcenter: %s", convert_err.Error())
 	}
 
-	go env.DiscordBot.NotifyChannels(diffs)
-	UpdateMissingGPUs(env, data.GPUs)
+	return &data, nil
+}
 
-	env.LastScrapeTime = time.Now()
+// Records the time of the last successful scrape
+func (env *Env) SetLastScrapeTime(t time.Time) {
+	env.scrapeTimeMu.Lock()
+	defer env.scrapeTimeMu.Unlock()
+	env.LastScrapeTime = t
+}
 
-	return nil
+// Gets the time of the last successful scrape, or the zero time if there hasn't been one
+func (env *Env) GetLastScrapeTime() time.Time {
+	env.scrapeTimeMu.RLock()
+	defer env.scrapeTimeMu.RUnlock()
+	return env.LastScrapeTime
 }
 
 func Difference(gpu *GPU, env *Env) (*GPUDifference, error) {
@@ -102,7 +225,7 @@ func Difference(gpu *GPU, env *Env) (*GPUDifference, error) {
 }
 
 // Log the number of GPUs we are currently tracking in the database
-func ReportGPUData(env *Env) error {
+func ReportGPUData(ctx context.Context, env *Env) error {
 	gpus, err := GetAllGPUs(env)
 	if err != nil {
 		return fmt.Errorf("error in updating GPU data: %s", err.Error())
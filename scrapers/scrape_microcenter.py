@@ -4,9 +4,21 @@ import datetime
 import argparse
 from bs4 import BeautifulSoup
 
-def scrape(source):
-    req = requests.get(source)
-    soup = BeautifulSoup(req.content, 'html.parser')
+def scrape(source, html_in=None, html_out=None):
+    if html_in is not None:
+        # parse a page saved by an earlier scrape instead of fetching it
+        with open(html_in, 'rb') as f:
+            content = f.read()
+    else:
+        req = requests.get(source)
+        content = req.content
+
+    # save the page before parsing so it is kept even if parsing fails
+    if html_out is not None:
+        with open(html_out, 'wb') as f:
+            f.write(content)
+
+    soup = BeautifulSoup(content, 'html.parser')
     productGrid = soup.find('article', {'id': 'productGrid'}).find('ul')
     items = productGrid.find_all('li')
 
@@ -96,9 +108,11 @@ def main():
     parser = argparse.ArgumentParser(description='Scrape Microcenter website for GPU listings')
     parser.add_argument('-s', '--source', required=True, dest='source', action='store', help='Source URL to scrape')
     parser.add_argument('-p', '--pretty', dest='pretty', action='store_true', help='Format the result JSON for human readability')
+    parser.add_argument('--html-in', dest='html_in', action='store', help='Parse this saved page instead of fetching the source URL')
+    parser.add_argument('--html-out', dest='html_out', action='store', help='Save the fetched page to this file')
     args = parser.parse_args()
 
-    data = scrape(args.source)
+    data = scrape(args.source, args.html_in, args.html_out)
 
     if args.pretty:
         print(json.dumps(data, indent=2, sort_keys=True))
@@ -0,0 +1,40 @@
+// Keep the GPU table up to date with changes pushed from the /events stream
+const rows = document.getElementById("gpu-rows");
+const source = new EventSource("/events" + window.location.search);
+
+function createRow(gpu) {
+    const row = document.createElement("tr");
+    row.id = "gpu-" + gpu.id;
+
+    const name = document.createElement("td");
+    const link = document.createElement("a");
+    link.href = gpu.link;
+    link.textContent = [gpu.manufacturer, gpu.line, gpu.model].join(" ");
+    name.appendChild(link);
+
+    const price = document.createElement("td");
+    price.className = "price";
+    const stock = document.createElement("td");
+    stock.className = "stock";
+
+    row.append(name, price, stock);
+    rows.appendChild(row);
+    return row;
+}
+
+source.addEventListener("gpu", (e) => {
+    const gpu = JSON.parse(e.data);
+    let row = document.getElementById("gpu-" + gpu.id);
+
+    if (gpu.stock_new === 0) {
+        if (row) row.remove();
+        return;
+    }
+
+    if (!row) row = createRow(gpu);
+    row.querySelector(".price").textContent = "$" + gpu.price_new.toFixed(2);
+    row.querySelector(".stock").textContent = gpu.stock_new;
+
+    row.classList.remove("updated", "price-drop");
+    row.classList.add(gpu.price_drop ? "price-drop" : "updated");
+});
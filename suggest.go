@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Most choices Discord accepts in an autocomplete response
+const maxSuggestions = 25
+
+// A model, line or brand that could be used as a rule query, and how many GPUs it matches
+type QuerySuggestion struct {
+	Value   string
+	Matches int
+	InStock int
+}
+
+// Describes the suggestion for an autocomplete choice, such as "4070 Ti (12 GPUs, 5 in stock)"
+func (s *QuerySuggestion) String() string {
+	noun := "GPUs"
+	if s.Matches == 1 {
+		noun = "GPU"
+	}
+
+	return fmt.Sprintf("%s (%d %s, %d in stock)", s.Value, s.Matches, noun, s.InStock)
+}
+
+// Suggests models, lines and brands from the GPU table that contain text, ranked by how many GPUs each
+// would match as a rule query. If brand is set only GPUs of that brand are counted. The candidates are
+// found and counted in a single query, matching GPUs the same way QueryRule does.
+func SuggestQueries(env *Env, text string, brand string, limit int) ([]*QuerySuggestion, error) {
+	pattern := "%" + escapeLike(strings.ToLower(strings.TrimSpace(text))) + "%"
+
+	// Limits GPUs to the brand, if there is one, given the prefix qualifying their columns
+	brandCondition := func(prefix string) string {
+		if brand == "" {
+			return ""
+		}
+		return " AND LOWER(" + prefix + "brand) = ?"
+	}
+	var brandArgs []any
+	if brand != "" {
+		brandArgs = append(brandArgs, strings.ToLower(brand))
+	}
+
+	// Every model, line and brand containing the text is a candidate query, once whatever its case
+	var candidates []string
+	var args []any
+	for _, column := range []string{"product_model", "line", "brand"} {
+		candidates = append(candidates, fmt.Sprintf(
+			`SELECT TRIM(%[1]s) AS value FROM gpus WHERE deleted_at IS NULL AND LOWER(%[1]s) LIKE ? ESCAPE '\' AND TRIM(%[1]s) <> '' AND LENGTH(TRIM(%[1]s)) <= ?`,
+			column,
+		)+brandCondition(""))
+		args = append(args, pattern, maxRuleQueryLength)
+		args = append(args, brandArgs...)
+	}
+
+	// Each candidate is escaped and used as the pattern QueryRule would build from it
+	candidatePattern := `'%' || REPLACE(REPLACE(REPLACE(LOWER(candidates.value), '\', '\\'), '%', '\%'), '_', '\_') || '%'`
+	sql := "SELECT candidates.value, COUNT(gpus.id) AS matches, SUM(CASE WHEN gpus.stock > 0 THEN 1 ELSE 0 END) AS in_stock " +
+		"FROM (SELECT MIN(value) AS value FROM (" + strings.Join(candidates, " UNION ") + ") AS candidate_values GROUP BY LOWER(value)) AS candidates " +
+		"JOIN gpus ON gpus.deleted_at IS NULL AND " + ruleQueryCondition("gpus.", candidatePattern) + brandCondition("gpus.") +
+		" GROUP BY candidates.value ORDER BY matches DESC, candidates.value LIMIT ?"
+	args = append(args, brandArgs...)
+	args = append(args, limit)
+
+	var suggestions []*QuerySuggestion
+	result := env.DB.Raw(sql, args...).Scan(&suggestions)
+	if result.Error != nil {
+		return nil, fmt.Errorf("could not suggest queries: %s", result.Error)
+	}
+
+	return suggestions, nil
+}
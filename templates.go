@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+)
+
+// Templates and static web assets compiled into the binary
+//
+//go:embed templates static
+var assets embed.FS
+
+// Renders HTML pages from the templates directory. Every page in templates/pages is parsed together with
+// templates/layout.html and all of templates/partials, so a page only has to define the blocks it fills in.
+// Templates are parsed once at startup unless dev mode is on, in which case they are re-read from disk on
+// every render so they can be edited without rebuilding.
+type Renderer struct {
+	fsys  fs.FS
+	dev   bool
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+}
+
+// Parses every page template found in fsys
+func (r *Renderer) parse() (map[string]*template.Template, error) {
+	pageFiles, err := fs.Glob(r.fsys, "templates/pages/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("could not list page templates: %s", err.Error())
+	}
+
+	partialFiles, err := fs.Glob(r.fsys, "templates/partials/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("could not list partial templates: %s", err.Error())
+	}
+
+	pages := make(map[string]*template.Template)
+	for _, file := range pageFiles {
+		files := append([]string{"templates/layout.html"}, partialFiles...)
+		files = append(files, file)
+
+		tmpl, err := template.New("layout.html").Funcs(templateFuncs).ParseFS(r.fsys, files...)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse template %s: %s", file, err.Error())
+		}
+
+		name := path.Base(file)
+		pages[name[:len(name)-len(path.Ext(name))]] = tmpl
+	}
+
+	return pages, nil
+}
+
+// Returns the parsed template for a page, reloading from disk first when in dev mode
+func (r *Renderer) lookup(page string) (*template.Template, error) {
+	if r.dev {
+		pages, err := r.parse()
+		if err != nil {
+			return nil, err
+		}
+
+		r.mu.Lock()
+		r.pages = pages
+		r.mu.Unlock()
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tmpl, ok := r.pages[page]
+	if !ok {
+		return nil, fmt.Errorf("no template for page %s", page)
+	}
+
+	return tmpl, nil
+}
+
+// Executes a page with the given data. The page is rendered into a buffer first so that a template error
+// never leaves a half-written response.
+func (r *Renderer) Render(w io.Writer, page string, data any) error {
+	tmpl, err := r.lookup(page)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.ExecuteTemplate(&buf, "layout", data)
+	if err != nil {
+		return fmt.Errorf("could not render page %s: %s", page, err.Error())
+	}
+
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// Executes a single named partial, such as a table row, without the surrounding layout
+func (r *Renderer) RenderPartial(w io.Writer, page string, partial string, data any) error {
+	tmpl, err := r.lookup(page)
+	if err != nil {
+		return err
+	}
+
+	return tmpl.ExecuteTemplate(w, partial, data)
+}
+
+// Returns the file system static assets are served from
+func (r *Renderer) Static() fs.FS {
+	static, _ := fs.Sub(r.fsys, "static")
+	return static
+}
+
+// Functions available to every template
+var templateFuncs = template.FuncMap{
+	"price": func(p float64) string {
+		return fmt.Sprintf("$%.2f", p)
+	},
+	// Builds a map from alternating keys and values so partials can be passed more than one value
+	"dict": func(pairs ...any) (map[string]any, error) {
+		if len(pairs)%2 != 0 {
+			return nil, fmt.Errorf("dict requires an even number of arguments")
+		}
+
+		m := make(map[string]any, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			key, ok := pairs[i].(string)
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings")
+			}
+			m[key] = pairs[i+1]
+		}
+
+		return m, nil
+	},
+}
+
+// Creates a Renderer. In dev mode templates and assets are read from the working directory instead of the
+// copies embedded in the binary.
+func NewRenderer(dev bool) (*Renderer, error) {
+	var fsys fs.FS = assets
+	if dev {
+		fsys = os.DirFS(".")
+	}
+
+	r := &Renderer{
+		fsys: fsys,
+		dev:  dev,
+	}
+
+	pages, err := r.parse()
+	if err != nil {
+		return nil, err
+	}
+	r.pages = pages
+
+	return r, nil
+}
@@ -1,82 +1,596 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"reflect"
+	"math/rand/v2"
+	"runtime/debug"
+	"slices"
+	"sync"
 	"time"
 )
 
-// A structure for asynchronously running several different functions on a loop.
-// Functions will be added to a map of callbacks that, when the UpdateManager is started,
-// will run on loop every d duration until the manager is stopped.
+// Delay before the first retry of a failed job. Each further consecutive failure doubles the delay
+// up to retryMaxDelay.
+const (
+	retryBaseDelay = 15 * time.Second
+	retryMaxDelay  = 10 * time.Minute
+	// Fraction of the retry delay that is randomly added or removed so retries don't line up
+	retryJitter = 0.2
+)
+
+// The shortest interval a job can be scheduled at, whether by config or by SetInterval
+const minJobInterval = time.Minute
+
+// Returned when a job is triggered while a previous run of it is still in progress
+var ErrJobRunning = errors.New("job is already running")
+
+// Returned when a job is triggered after the UpdateManager has been stopped
+var ErrManagerStopped = errors.New("update manager is stopped")
+
+// A structure for asynchronously running several different named jobs on a loop.
+// Jobs are registered in order and, when the UpdateManager is started, each runs on its own
+// schedule until the manager is stopped. Jobs added without a schedule run every d duration.
+//
+// A job may depend on other jobs with JobOptions.After, in which case it runs right after each
+// successful run of its dependencies instead of on its own. Dependencies must be registered first,
+// so registration order is always a valid run order.
+//
+// Each job is isolated from the others: an error or panic in one job is recorded in its JobStatus and
+// the job is retried with exponential backoff, while the remaining jobs and the rest of the program keep
+// running. At most one run of a job happens at a time; if a run is still going when the next one is due,
+// the next one is skipped.
+//
+// Jobs are passed a context that is only cancelled if Shutdown's deadline passes before they finish.
+//
+// The registry is safe for concurrent use.
 type UpdateManager struct {
-	updateTicker *time.Ticker
-	callbacks    map[uintptr]func(*Env) error
-	doneChannel  chan bool
-	environment  *Env
+	defaultSchedule Schedule
+	jobs            map[string]*job
+	order           []string
+	doneChannel     chan bool
+	environment     *Env
+	mu              sync.RWMutex
+	started         bool
+	stopped         bool
+	ctx             context.Context
+	cancel          context.CancelFunc
+	running         sync.WaitGroup
+}
+
+// Per job options for UpdateManager.Add
+type JobOptions struct {
+	// When the job runs. Defaults to the UpdateManager's interval, unless After is set in which case the
+	// job only runs after its dependencies.
+	Schedule Schedule
+	// Each scheduled run is delayed by a random duration of up to Jitter
+	Jitter time.Duration
+	// Names of jobs that must succeed before this job runs. The job runs after each successful run of
+	// any of them.
+	After []string
+}
+
+// A registered job along with its run state
+type job struct {
+	name    string
+	fn      func(context.Context, *Env) error
+	opts    JobOptions
+	runMu   sync.Mutex
+	mu      sync.Mutex
+	status  JobStatus
+	retry   *time.Timer
+	removed chan bool
+	// Signals the job's loop to recompute its next run after the schedule changes
+	reschedule chan bool
+}
+
+// The outcome of the most recent run of an UpdateManager job
+type JobStatus struct {
+	Name                string        `json:"name"`
+	LastRun             time.Time     `json:"last_run,omitzero"`
+	LastDuration        time.Duration `json:"last_duration_ns"`
+	LastSuccess         time.Time     `json:"last_success,omitzero"`
+	LastError           string        `json:"last_error,omitempty"`
+	LastErrorTime       time.Time     `json:"last_error_time,omitzero"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	NextRetry           time.Time     `json:"next_retry,omitzero"`
+	Schedule            string        `json:"schedule,omitempty"`
+	After               []string      `json:"after,omitempty"`
+	NextRun             time.Time     `json:"next_run,omitzero"`
+	Running             bool          `json:"running"`
+	Paused              bool          `json:"paused"`
+}
+
+// Gets the registered jobs in registration order
+func (um *UpdateManager) orderedJobs() []*job {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	jobs := make([]*job, 0, len(um.order))
+	for _, name := range um.order {
+		jobs = append(jobs, um.jobs[name])
+	}
+
+	return jobs
+}
+
+// Gets the jobs that list name in their After option, in registration order
+func (um *UpdateManager) dependents(name string) []*job {
+	var jobs []*job
+	for _, j := range um.orderedJobs() {
+		if slices.Contains(j.opts.After, name) {
+			jobs = append(jobs, j)
+		}
+	}
+
+	return jobs
 }
 
-// Runs the callbacks for the UpdateManager
+// Runs every job once in registration order. A job whose dependencies did not succeed in this pass is
+// skipped. Every other job is run even if an earlier one fails, and the errors from all failed jobs are
+// returned together.
 func (um *UpdateManager) emit() error {
-	for _, fn := range um.callbacks {
-		err := fn(um.environment)
+	failed := make(map[string]bool)
+
+	var errs []error
+	for _, j := range um.orderedJobs() {
+		blocked := false
+		for _, dep := range j.opts.After {
+			if failed[dep] {
+				blocked = true
+			}
+		}
+		if blocked {
+			log.Printf("Skipping update manager job %s: a dependency failed\n", j.name)
+			failed[j.name] = true
+			continue
+		}
+
+		err := um.run(j)
+		if err != nil {
+			failed[j.name] = true
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Runs a job and then, if it succeeded, every job that depends on it
+func (um *UpdateManager) runChain(j *job) error {
+	err := um.run(j)
+	if err != nil {
+		return err
+	}
+
+	for _, dep := range um.dependents(j.name) {
+		um.runChain(dep)
+	}
+
+	return nil
+}
+
+// Runs a single job, recovering from any panic, recording the result and scheduling a retry on failure.
+// If the job is already running it is not started again and ErrJobRunning is returned.
+func (um *UpdateManager) run(j *job) (err error) {
+	if !j.runMu.TryLock() {
+		log.Printf("Skipping update manager job %s: previous run still in progress\n", j.name)
+		return ErrJobRunning
+	}
+	defer j.runMu.Unlock()
+
+	// Checking stopped under the manager lock guarantees no run starts once Shutdown is waiting
+	um.mu.RLock()
+	if um.stopped {
+		um.mu.RUnlock()
+		return ErrManagerStopped
+	}
+	um.running.Add(1)
+	um.mu.RUnlock()
+	defer um.running.Done()
+
+	j.mu.Lock()
+	j.status.Running = true
+	j.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			log.Printf("Recovered from panic in update manager job %s: %v\n%s", j.name, r, debug.Stack())
+		}
+
+		um.record(j, start, err)
 		if err != nil {
-			return fmt.Errorf("error in update manager callback: %s", err.Error())
+			err = fmt.Errorf("error in update manager job %s: %s", j.name, err.Error())
+			log.Println(err)
+		}
+	}()
+
+	return j.fn(um.ctx, um.environment)
+}
+
+// Records the result of a job run in its JobStatus and metrics, and schedules a retry if it failed
+func (um *UpdateManager) record(j *job, start time.Time, err error) {
+	duration := time.Since(start)
+
+	// The manager lock must always be taken before a job's lock
+	um.mu.RLock()
+	stopped := um.stopped
+	um.mu.RUnlock()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	updateCallbackDuration.WithLabelValues(j.name, outcomeLabel(err)).Observe(duration.Seconds())
+
+	j.status.LastRun = start
+	j.status.LastDuration = duration
+	j.status.Running = false
+	if err == nil {
+		j.status.LastSuccess = time.Now()
+		j.status.LastError = ""
+		j.status.ConsecutiveFailures = 0
+		j.status.NextRetry = time.Time{}
+		if j.retry != nil {
+			j.retry.Stop()
+			j.retry = nil
+		}
+		return
+	}
+
+	j.status.LastError = err.Error()
+	j.status.LastErrorTime = time.Now()
+	j.status.ConsecutiveFailures++
+
+	if j.retry != nil {
+		j.retry.Stop()
+		j.retry = nil
+	}
+	// A paused job is only run when triggered by hand, so its failures aren't retried
+	if stopped || j.status.Paused {
+		j.status.NextRetry = time.Time{}
+		return
+	}
+
+	delay := retryDelay(j.status.ConsecutiveFailures)
+	j.status.NextRetry = time.Now().Add(delay)
+	j.retry = time.AfterFunc(delay, func() {
+		um.mu.RLock()
+		registered := um.jobs[j.name] == j
+		stopped := um.stopped
+		um.mu.RUnlock()
+
+		j.mu.Lock()
+		paused := j.status.Paused
+		j.mu.Unlock()
+
+		if registered && !stopped && !paused {
+			um.runChain(j)
+		}
+	})
+}
+
+// Runs a job each time its schedule comes due until the job is removed or the manager is stopped
+func (um *UpdateManager) loop(j *job) {
+	for {
+		j.mu.Lock()
+		schedule := j.opts.Schedule
+		j.mu.Unlock()
+
+		next := schedule.Next(time.Now())
+		if j.opts.Jitter > 0 {
+			next = next.Add(rand.N(j.opts.Jitter))
+		}
+
+		j.mu.Lock()
+		j.status.NextRun = next
+		j.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-um.doneChannel:
+			timer.Stop()
+			return
+		case <-j.removed:
+			timer.Stop()
+			return
+		case <-j.reschedule:
+			timer.Stop()
+		case <-timer.C:
+			j.mu.Lock()
+			paused := j.status.Paused
+			j.mu.Unlock()
+
+			if paused {
+				log.Printf("Skipping update manager job %s: paused\n", j.name)
+				continue
+			}
+			um.runChain(j)
+		}
+	}
+}
+
+// Gets a registered job by name
+func (um *UpdateManager) job(name string) (*job, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	j, ok := um.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("update manager job %s does not exist", name)
+	}
+
+	return j, nil
+}
+
+// Starts a run of a job and its dependents in the background, regardless of its schedule or whether
+// it is paused
+func (um *UpdateManager) Trigger(name string) error {
+	j, err := um.job(name)
+	if err != nil {
+		return err
+	}
+
+	um.mu.RLock()
+	stopped := um.stopped
+	um.mu.RUnlock()
+	if stopped {
+		return ErrManagerStopped
+	}
+
+	j.mu.Lock()
+	running := j.status.Running
+	j.mu.Unlock()
+	if running {
+		return ErrJobRunning
+	}
+
+	log.Printf("Manually triggering update manager job %s\n", name)
+	go um.runChain(j)
+
+	return nil
+}
+
+// Pauses or resumes a job's schedule. Pausing cancels any pending retry. A paused job can still be run
+// with Trigger or as a dependent of another job, but its failures aren't retried.
+func (um *UpdateManager) SetPaused(name string, paused bool) error {
+	j, err := um.job(name)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.opts.Schedule == nil {
+		return fmt.Errorf("update manager job %s has no schedule of its own", name)
+	}
+	j.status.Paused = paused
+	if paused && j.retry != nil {
+		j.retry.Stop()
+		j.retry = nil
+		j.status.NextRetry = time.Time{}
+	}
+
+	return nil
+}
+
+// Changes a job to run every d from now on. Jobs that only run after another job can't be given an
+// interval.
+func (um *UpdateManager) SetInterval(name string, d time.Duration) error {
+	if d < minJobInterval {
+		return fmt.Errorf("interval must be at least 1m")
+	}
+
+	j, err := um.job(name)
+	if err != nil {
+		return err
+	}
+
+	schedule := Every(d)
+
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	j.mu.Lock()
+	if j.opts.Schedule == nil {
+		j.mu.Unlock()
+		return fmt.Errorf("update manager job %s has no schedule of its own", name)
+	}
+	j.opts.Schedule = schedule
+	j.status.Schedule = schedule.String()
+	j.mu.Unlock()
+
+	if um.started && !um.stopped {
+		select {
+		case j.reschedule <- true:
+		default:
 		}
 	}
 
+	log.Printf("Update manager job %s now runs %s\n", name, schedule)
+
 	return nil
 }
 
-// Forces the UpdateManager to run all callbacks now
+// Gets the backoff delay before retrying a job that has failed n times in a row
+func retryDelay(n int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < n && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, retryMaxDelay)
+
+	jitter := (rand.Float64()*2 - 1) * retryJitter * float64(delay)
+	return delay + time.Duration(jitter)
+}
+
+// Gets a copy of the status of every registered job in registration order
+func (um *UpdateManager) Status() []JobStatus {
+	jobs := um.orderedJobs()
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		j.mu.Lock()
+		statuses = append(statuses, j.status)
+		j.mu.Unlock()
+	}
+
+	return statuses
+}
+
+// Forces the UpdateManager to run all jobs now
 func (um *UpdateManager) UpdateNow() error {
 	return um.emit()
 }
 
-// Adds a function to the callback map. Will run every time the UpdateManager loops
-func (um *UpdateManager) Add(fn func(*Env) error) {
-	ptr := reflect.ValueOf(fn).Pointer()
-	um.callbacks[ptr] = fn
+// Registers a job under a unique name. Jobs named in opts.After must already be registered.
+func (um *UpdateManager) Add(name string, fn func(context.Context, *Env) error, opts JobOptions) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if _, ok := um.jobs[name]; ok {
+		return fmt.Errorf("update manager job %s already exists", name)
+	}
+	for _, dep := range opts.After {
+		if _, ok := um.jobs[dep]; !ok {
+			return fmt.Errorf("update manager job %s depends on unknown job %s", name, dep)
+		}
+	}
+
+	if opts.Schedule == nil && len(opts.After) == 0 {
+		opts.Schedule = um.defaultSchedule
+	}
+
+	j := &job{
+		name:       name,
+		fn:         fn,
+		opts:       opts,
+		status:     JobStatus{Name: name, After: opts.After},
+		removed:    make(chan bool),
+		reschedule: make(chan bool, 1),
+	}
+	if opts.Schedule != nil {
+		j.status.Schedule = opts.Schedule.String()
+	}
+
+	um.jobs[name] = j
+	um.order = append(um.order, name)
+
+	if um.started && !um.stopped && opts.Schedule != nil {
+		go um.loop(j)
+	}
+
+	return nil
 }
 
-// Removes a function from the callback map
-func (um *UpdateManager) Remove(fn func(*Env) error) {
-	ptr := reflect.ValueOf(fn).Pointer()
-	delete(um.callbacks, ptr)
+// Removes a job by name and cancels its schedule and any pending retry. A job that other jobs depend on
+// cannot be removed until they are.
+func (um *UpdateManager) Remove(name string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	j, ok := um.jobs[name]
+	if !ok {
+		return fmt.Errorf("update manager job %s does not exist", name)
+	}
+	for _, other := range um.jobs {
+		if slices.Contains(other.opts.After, name) {
+			return fmt.Errorf("update manager job %s is needed by job %s", name, other.name)
+		}
+	}
+
+	close(j.removed)
+	j.mu.Lock()
+	if j.retry != nil {
+		j.retry.Stop()
+		j.retry = nil
+	}
+	j.mu.Unlock()
+
+	delete(um.jobs, name)
+	um.order = slices.DeleteFunc(um.order, func(n string) bool { return n == name })
+
+	return nil
 }
 
-// Starts the UpdateManager loop. Will run until an error from a callback or until the doneChannel recieves true
+// Starts the schedule of every job. Jobs run until the doneChannel is closed by Stop. Errors from
+// jobs are logged and retried but never stop the loop.
 func (um *UpdateManager) Start() {
 	log.Println("Starting update loop")
 
-	go func() {
-		for {
-			select {
-			case <-um.doneChannel:
-				log.Println("Update loop stopped")
-				return
-			case <-um.updateTicker.C:
-				err := um.emit()
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.started {
+		return
+	}
+	um.started = true
+
+	for _, name := range um.order {
+		if j := um.jobs[name]; j.opts.Schedule != nil {
+			go um.loop(j)
 		}
-	}()
+	}
 }
 
-// Stops the UpdateManager loop by sending true through the doneChannel
+// Stops every job's schedule by closing the doneChannel and cancels pending retries
 func (um *UpdateManager) Stop() {
-	um.doneChannel <- true
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.stopped {
+		return
+	}
+	um.stopped = true
+
+	for _, j := range um.jobs {
+		j.mu.Lock()
+		if j.retry != nil {
+			j.retry.Stop()
+			j.retry = nil
+		}
+		j.status.NextRetry = time.Time{}
+		j.status.NextRun = time.Time{}
+		j.mu.Unlock()
+	}
+
+	close(um.doneChannel)
+	log.Println("Update loop stopped")
+}
+
+// Stops scheduling jobs and waits for any jobs that are running to finish. If ctx is done before they
+// finish, the context passed to the jobs is cancelled and ctx's error is returned.
+func (um *UpdateManager) Shutdown(ctx context.Context) error {
+	um.Stop()
+
+	done := make(chan bool)
+	go func() {
+		um.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		um.cancel()
+		return nil
+	case <-ctx.Done():
+		log.Println("Update manager jobs did not finish in time, cancelling them")
+		um.cancel()
+		return fmt.Errorf("error in shutting down update manager: %s", ctx.Err().Error())
+	}
 }
 
-// Creates a new UpdateManager whose update interval is set by a duration d
+// Creates a new UpdateManager whose default update interval is set by a duration d
 func NewUpdateManager(env *Env, d time.Duration) *UpdateManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &UpdateManager{
-		callbacks:    make(map[uintptr]func(*Env) error),
-		doneChannel:  make(chan bool),
-		updateTicker: time.NewTicker(d),
-		environment:  env,
+		defaultSchedule: Every(d),
+		jobs:            make(map[string]*job),
+		doneChannel:     make(chan bool),
+		environment:     env,
+		ctx:             ctx,
+		cancel:          cancel,
 	}
 }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Creates an UpdateManager that is stopped when the test ends, cancelling any pending retries
+func newTestUpdateManager(t *testing.T) *UpdateManager {
+	t.Helper()
+
+	um := NewUpdateManager(&Env{}, time.Hour)
+	t.Cleanup(um.Stop)
+
+	return um
+}
+
+// Records the order jobs run in
+type runLog struct {
+	mu   sync.Mutex
+	runs []string
+}
+
+// Makes a job function that records its name and returns err
+func (l *runLog) job(name string, err error) func(context.Context, *Env) error {
+	return func(context.Context, *Env) error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.runs = append(l.runs, name)
+		return err
+	}
+}
+
+func (l *runLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.runs)
+}
+
+// Gets the status of a job by name
+func jobStatus(t *testing.T, um *UpdateManager, name string) JobStatus {
+	t.Helper()
+
+	for _, status := range um.Status() {
+		if status.Name == name {
+			return status
+		}
+	}
+	t.Fatalf("no status for job %s", name)
+	return JobStatus{}
+}
+
+func TestUpdateNowRunsDependenciesFirst(t *testing.T) {
+	um := newTestUpdateManager(t)
+	log := &runLog{}
+
+	um.Add("scrape", log.job("scrape", nil), JobOptions{})
+	um.Add("report", log.job("report", nil), JobOptions{After: []string{"scrape"}})
+	um.Add("summary", log.job("summary", nil), JobOptions{After: []string{"report"}})
+	um.Add("retention", log.job("retention", nil), JobOptions{Schedule: Every(time.Hour)})
+
+	err := um.UpdateNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"scrape", "report", "summary", "retention"}
+	if got := log.get(); !slices.Equal(got, want) {
+		t.Errorf("got runs %v, want %v", got, want)
+	}
+}
+
+func TestUpdateNowSkipsJobsAfterFailedDependency(t *testing.T) {
+	um := newTestUpdateManager(t)
+	log := &runLog{}
+	failure := errors.New("microcenter is down")
+
+	um.Add("scrape", log.job("scrape", failure), JobOptions{})
+	um.Add("report", log.job("report", nil), JobOptions{After: []string{"scrape"}})
+	um.Add("summary", log.job("summary", nil), JobOptions{After: []string{"report"}})
+	um.Add("retention", log.job("retention", nil), JobOptions{Schedule: Every(time.Hour)})
+
+	err := um.UpdateNow()
+	if err == nil {
+		t.Fatal("got no error from a failed job")
+	}
+
+	// Jobs that don't depend on the failed one still run
+	want := []string{"scrape", "retention"}
+	if got := log.get(); !slices.Equal(got, want) {
+		t.Errorf("got runs %v, want %v", got, want)
+	}
+	if status := jobStatus(t, um, "report"); !status.LastRun.IsZero() {
+		t.Errorf("skipped job has a last run of %s", status.LastRun)
+	}
+	if status := jobStatus(t, um, "scrape"); status.ConsecutiveFailures != 1 || status.NextRetry.IsZero() {
+		t.Errorf("failed job has %d failures and next retry %s, want 1 failure and a retry", status.ConsecutiveFailures, status.NextRetry)
+	}
+}
+
+func TestRunChainStopsAtFailedJob(t *testing.T) {
+	um := newTestUpdateManager(t)
+	log := &runLog{}
+
+	um.Add("scrape", log.job("scrape", nil), JobOptions{})
+	um.Add("report", log.job("report", errors.New("discord is down")), JobOptions{After: []string{"scrape"}})
+	um.Add("summary", log.job("summary", nil), JobOptions{After: []string{"report"}})
+
+	j, err := um.job("scrape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.runChain(j)
+
+	want := []string{"scrape", "report"}
+	if got := log.get(); !slices.Equal(got, want) {
+		t.Errorf("got runs %v, want %v", got, want)
+	}
+}
+
+func TestRetryDelayBacksOff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, retryBaseDelay},
+		{2, 2 * retryBaseDelay},
+		{3, 4 * retryBaseDelay},
+		{6, 32 * retryBaseDelay},
+		// Doubling stops at the maximum
+		{7, retryMaxDelay},
+		{50, retryMaxDelay},
+	}
+
+	for _, test := range tests {
+		low := time.Duration(float64(test.want) * (1 - retryJitter))
+		high := time.Duration(float64(test.want) * (1 + retryJitter))
+
+		for range 20 {
+			if got := retryDelay(test.failures); got < low || got > high {
+				t.Errorf("%d failures: got delay %s, want %s with %v jitter", test.failures, got, test.want, retryJitter)
+				break
+			}
+		}
+	}
+}
+
+func TestJobRunsDoNotOverlap(t *testing.T) {
+	um := newTestUpdateManager(t)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	runs := 0
+	um.Add("scrape", func(context.Context, *Env) error {
+		runs++
+		started <- true
+		<-release
+		return nil
+	}, JobOptions{})
+
+	j, err := um.job("scrape")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- um.run(j) }()
+	<-started
+
+	// Whether triggered by hand or by its schedule, a job can't start while it's still running
+	if err := um.Trigger("scrape"); !errors.Is(err, ErrJobRunning) {
+		t.Errorf("Trigger while running: got error %v, want %v", err, ErrJobRunning)
+	}
+	if err := um.run(j); !errors.Is(err, ErrJobRunning) {
+		t.Errorf("run while running: got error %v, want %v", err, ErrJobRunning)
+	}
+
+	close(release)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Errorf("job ran %d times, want 1", runs)
+	}
+	if jobStatus(t, um, "scrape").Running {
+		t.Error("job is still marked as running")
+	}
+}
+
+func TestSetPaused(t *testing.T) {
+	um := newTestUpdateManager(t)
+	log := &runLog{}
+
+	um.Add("scrape", log.job("scrape", errors.New("microcenter is down")), JobOptions{})
+	um.Add("report", log.job("report", nil), JobOptions{After: []string{"scrape"}})
+
+	if err := um.SetPaused("report", true); err == nil {
+		t.Error("paused a job with no schedule of its own")
+	}
+	if err := um.SetPaused("missing", true); err == nil {
+		t.Error("paused a job that doesn't exist")
+	}
+
+	// Pausing cancels the retry of a failed job
+	um.UpdateNow()
+	if jobStatus(t, um, "scrape").NextRetry.IsZero() {
+		t.Fatal("failed job has no retry")
+	}
+	err := um.SetPaused("scrape", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := jobStatus(t, um, "scrape")
+	if !status.Paused || !status.NextRetry.IsZero() {
+		t.Errorf("got paused %t and next retry %s, want paused with no retry", status.Paused, status.NextRetry)
+	}
+
+	// A paused job can still be run, but its failures aren't retried
+	um.UpdateNow()
+	status = jobStatus(t, um, "scrape")
+	if status.ConsecutiveFailures != 2 || !status.NextRetry.IsZero() {
+		t.Errorf("got %d failures and next retry %s, want 2 failures and no retry", status.ConsecutiveFailures, status.NextRetry)
+	}
+
+	err = um.SetPaused("scrape", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobStatus(t, um, "scrape").Paused {
+		t.Error("job is still paused after resuming")
+	}
+}
+
+func TestSetIntervalMinimum(t *testing.T) {
+	um := newTestUpdateManager(t)
+	um.Add("scrape", func(context.Context, *Env) error { return nil }, JobOptions{})
+
+	if err := um.SetInterval("scrape", 30*time.Second); err == nil {
+		t.Errorf("set an interval under %s", minJobInterval)
+	}
+
+	err := um.SetInterval("scrape", minJobInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := jobStatus(t, um, "scrape").Schedule, Every(minJobInterval).String(); got != want {
+		t.Errorf("got schedule %q, want %q", got, want)
+	}
+}
+
+func TestCronScheduleAcrossDST(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %s", err.Error())
+	}
+
+	schedule, err := ParseCron("0 9 * * *", newYork)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		after time.Time
+		// The run after the DST change stays at 9:00 local time, so it's an hour closer or further in UTC
+		want time.Time
+		gap  time.Duration
+	}{
+		{"spring forward", time.Date(2026, 3, 7, 9, 0, 0, 0, newYork), time.Date(2026, 3, 8, 13, 0, 0, 0, time.UTC), 23 * time.Hour},
+		{"fall back", time.Date(2026, 10, 31, 9, 0, 0, 0, newYork), time.Date(2026, 11, 1, 14, 0, 0, 0, time.UTC), 25 * time.Hour},
+	}
+
+	for _, test := range tests {
+		next := schedule.Next(test.after)
+		if !next.Equal(test.want) {
+			t.Errorf("%s: got next run %s, want %s", test.name, next.UTC(), test.want)
+		}
+		if gap := next.Sub(test.after); gap != test.gap {
+			t.Errorf("%s: got %s between runs, want %s", test.name, gap, test.gap)
+		}
+	}
+}
+
+func TestParseCronTimeZone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %s", err.Error())
+	}
+
+	after := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		// Evaluated in the given zone
+		{"0 4 * * *", time.Date(2026, 6, 2, 4, 0, 0, 0, tokyo)},
+		// CRON_TZ takes precedence over it
+		{"CRON_TZ=UTC 0 4 * * *", time.Date(2026, 6, 1, 4, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseCron(test.expr, tokyo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := schedule.Next(after); !next.Equal(test.want) {
+			t.Errorf("%q: got next run %s, want %s", test.expr, next, test.want)
+		}
+	}
+}